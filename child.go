@@ -1,21 +1,47 @@
 package tableflip
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"time"
 )
 
 type child struct {
 	*env
 	proc           process
 	readyR, namesW *os.File
+	handoffW       *os.File
 	ready          <-chan *os.File
+	failed         <-chan error
 	result         <-chan error
 	exited         <-chan struct{}
+	// acceptsConns is true if the child accepts the number of open
+	// connections. Only valid once the child is ready.
+	acceptsConns bool
+	// probeAddr is advertised by the child for the readiness probe, or
+	// nil. Only valid once the child is ready.
+	probeAddr net.Addr
 }
 
-func startChild(env *env, passedFiles map[fileName]*file) (*child, error) {
+func startChild(env *env, passedFiles map[fileName]*file, opts UpgradeOptions, h handoff) (*child, error) {
+	executable, args := opts.Executable, opts.Args
+	if executable == "" {
+		executable = os.Args[0]
+	}
+	if args == nil {
+		args = os.Args[1:]
+	}
+
+	resolved, dir, err := resolveCommand(executable, opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't start process %s: %s", executable, err)
+	}
+
 	// These pipes are used for communication between parent and child
 	// readyW is passed to the child, readyR stays with the parent
 	readyR, readyW, err := os.Pipe()
@@ -30,51 +56,85 @@ func startChild(env *env, passedFiles map[fileName]*file) (*child, error) {
 		return nil, fmt.Errorf("pipe failed: %s", err)
 	}
 
+	handoffR, handoffW, err := os.Pipe()
+	if err != nil {
+		readyR.Close()
+		readyW.Close()
+		namesR.Close()
+		namesW.Close()
+		return nil, fmt.Errorf("pipe failed: %s", err)
+	}
+
 	// Copy passed fds and append the notification pipe
 	fds := []*os.File{os.Stdin, os.Stdout, os.Stderr, readyW, namesR}
 	var fdNames [][]string
+	h.Version = handoffVersion
+	h.ParentPID = os.Getpid()
+	h.Timestamp = time.Now()
+	h.ReportsFinished = true
 	for name, file := range passedFiles {
 		nameSlice := make([]string, len(name))
 		copy(nameSlice, name[:])
 		fdNames = append(fdNames, nameSlice)
+		h.Files = append(h.Files, handoffFile{nameSlice, len(fds), file.meta})
 		fds = append(fds, file.File)
 	}
 
+	// The handoff pipe comes last, since children which only understand
+	// version 1 of the protocol expect passed fds to start at 5. It's
+	// announced in the names, so that the announcement can't outlive
+	// the child, unlike a variable in the environment.
+	fdNames = append(fdNames, []string{handoffKind})
+	fds = append(fds, handoffR)
+
 	// Copy environment and append the notification env vars
+	environ := env.environ()
+	if opts.Environ != nil {
+		environ = opts.Environ(append([]string(nil), environ...))
+	}
+
 	sentinel := fmt.Sprintf("%s=yes", sentinelEnvVar)
-	var environ []string
-	for _, val := range env.environ() {
+	var childEnviron []string
+	for _, val := range environ {
 		if val != sentinel {
-			environ = append(environ, val)
+			childEnviron = append(childEnviron, val)
 		}
 	}
-	environ = append(environ, sentinel)
+	childEnviron = append(childEnviron, sentinel)
 
-	proc, err := env.newProc(os.Args[0], os.Args[1:], fds, environ)
+	proc, err := env.newProc(resolved, args, dir, fds, childEnviron)
 	if err != nil {
 		readyR.Close()
 		readyW.Close()
 		namesR.Close()
 		namesW.Close()
-		return nil, fmt.Errorf("can't start process %s: %s", os.Args[0], err)
+		handoffR.Close()
+		handoffW.Close()
+		return nil, fmt.Errorf("can't start process %s: %s", resolved, err)
 	}
 
 	exited := make(chan struct{})
 	result := make(chan error, 1)
 	ready := make(chan *os.File, 1)
+	failed := make(chan error, 1)
 
 	c := &child{
 		env,
 		proc,
 		readyR,
 		namesW,
+		handoffW,
 		ready,
+		failed,
 		result,
 		exited,
+		false,
+		nil,
 	}
 	go c.writeNames(fdNames)
+	go c.writeHandoff(h)
 	go c.waitExit(result, exited)
-	go c.waitReady(ready)
+	go c.waitReady(ready, failed)
 	return c, nil
 }
 
@@ -89,22 +149,66 @@ func (c *child) Kill() {
 func (c *child) waitExit(result chan<- error, exited chan<- struct{}) {
 	result <- c.proc.Wait()
 	close(exited)
-	// Unblock waitReady and writeNames
+	// Unblock waitReady, writeNames and writeHandoff
 	c.readyR.Close()
 	c.namesW.Close()
+	c.handoffW.Close()
 }
 
-func (c *child) waitReady(ready chan<- *os.File) {
+func (c *child) waitReady(ready chan<- *os.File, failed chan<- error) {
 	var b [1]byte
-	if n, _ := c.readyR.Read(b[:]); n > 0 && b[0] == notifyReady {
-		// We know that writeNames has exited by this point.
-		// Closing the FD now signals to the child that the parent
-		// has exited.
-		ready <- c.namesW
+	if n, _ := c.readyR.Read(b[:]); n > 0 {
+		switch b[0] {
+		case notifyReady:
+			// Older children don't send flags, and close the pipe
+			// right away.
+			if n, _ := c.readyR.Read(b[:]); n > 0 {
+				c.acceptsConns = b[0]&acceptsConnCount != 0
+				if b[0]&hasProbeAddr != 0 {
+					c.probeAddr = c.readProbeAddr()
+				}
+			}
+
+			// We know that writeNames has exited by this point.
+			// Closing the FD now signals to the child that the parent
+			// has exited.
+			ready <- c.namesW
+
+		case notifyFailed:
+			var size uint16
+			if err := binary.Read(c.readyR, binary.BigEndian, &size); err != nil {
+				break
+			}
+
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(c.readyR, msg); err != nil {
+				break
+			}
+			failed <- errors.New(string(msg))
+		}
 	}
 	c.readyR.Close()
 }
 
+// readProbeAddr reads the address advertised for the readiness probe.
+// Returns nil if the child didn't send a valid address.
+func (c *child) readProbeAddr() net.Addr {
+	var parts [2]string
+	for i := range parts {
+		var size uint16
+		if err := binary.Read(c.readyR, binary.BigEndian, &size); err != nil {
+			return nil
+		}
+
+		str := make([]byte, size)
+		if _, err := io.ReadFull(c.readyR, str); err != nil {
+			return nil
+		}
+		parts[i] = string(str)
+	}
+	return fileAddr{parts[0], parts[1]}
+}
+
 func (c *child) writeNames(names [][]string) {
 	enc := gob.NewEncoder(c.namesW)
 	if names == nil {
@@ -114,3 +218,10 @@ func (c *child) writeNames(names [][]string) {
 	}
 	_ = enc.Encode(names)
 }
+
+func (c *child) writeHandoff(h handoff) {
+	// Children which only understand version 1 never read from the pipe,
+	// in which case we're blocked until they exit.
+	_ = gob.NewEncoder(c.handoffW).Encode(&h)
+	c.handoffW.Close()
+}
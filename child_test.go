@@ -1,14 +1,16 @@
 package tableflip
 
 import (
+	"errors"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestChildExit(t *testing.T) {
 	env, procs := testEnv()
 
-	child, err := startChild(env, nil)
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -23,7 +25,7 @@ func TestChildExit(t *testing.T) {
 func TestChildKill(t *testing.T) {
 	env, procs := testEnv()
 
-	child, err := startChild(env, nil)
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,7 +43,7 @@ func TestChildKill(t *testing.T) {
 func TestChildNotReady(t *testing.T) {
 	env, procs := testEnv()
 
-	child, err := startChild(env, nil)
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,7 +63,7 @@ func TestChildNotReady(t *testing.T) {
 func TestChildReady(t *testing.T) {
 	env, procs := testEnv()
 
-	child, err := startChild(env, nil)
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,6 +76,31 @@ func TestChildReady(t *testing.T) {
 	proc.exit(nil)
 }
 
+func TestChildFailed(t *testing.T) {
+	env, procs := testEnv()
+
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc := <-procs
+	if err := proc.fail(errors.New("invalid configuration")); err != nil {
+		t.Fatal("Can't send failure:", err)
+	}
+
+	if err := <-child.failed; err.Error() != "invalid configuration" {
+		t.Error("Expected failure message, got", err)
+	}
+
+	select {
+	case <-child.ready:
+		t.Error("Failed child signals readiness")
+	default:
+	}
+	proc.exit(nil)
+}
+
 func TestChildPassedFds(t *testing.T) {
 	env, procs := testEnv()
 
@@ -87,7 +114,7 @@ func TestChildPassedFds(t *testing.T) {
 		{"w"}: newFile(w.Fd(), fileName{"w"}),
 	}
 
-	if _, err := startChild(env, in); err != nil {
+	if _, err := startChild(env, in, UpgradeOptions{}, handoff{}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -111,3 +138,69 @@ func TestChildPassedFds(t *testing.T) {
 
 	proc.exit(nil)
 }
+
+func TestChildEnviron(t *testing.T) {
+	env, procs := testEnv()
+
+	environ := []string{"KEEP=1", "DROP=1", "OVERRIDE=old"}
+	env.environ = func() []string { return environ }
+
+	opts := UpgradeOptions{
+		Environ: func(environ []string) []string {
+			var result []string
+			for _, val := range environ {
+				switch {
+				case strings.HasPrefix(val, "DROP="):
+				case strings.HasPrefix(val, "OVERRIDE="):
+					result = append(result, "OVERRIDE=new")
+				default:
+					result = append(result, val)
+				}
+			}
+			return append(result, "ADD=1")
+		},
+	}
+
+	if _, err := startChild(env, nil, opts, handoff{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proc := <-procs
+	defer proc.exit(nil)
+
+	expected := map[string]string{
+		"KEEP":         "1",
+		"DROP":         "",
+		"OVERRIDE":     "new",
+		"ADD":          "1",
+		sentinelEnvVar: "yes",
+	}
+	for key, value := range expected {
+		if have := proc.env.getenv(key); have != value {
+			t.Errorf("Expected %s=%q in child, got %q", key, value, have)
+		}
+	}
+
+	if environ[1] != "DROP=1" || environ[2] != "OVERRIDE=old" {
+		t.Error("Environment of the current process was modified:", environ)
+	}
+}
+
+func TestChildEnvironCantRemoveSentinel(t *testing.T) {
+	env, procs := testEnv()
+
+	opts := UpgradeOptions{
+		Environ: func([]string) []string { return nil },
+	}
+
+	if _, err := startChild(env, nil, opts, handoff{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proc := <-procs
+	defer proc.exit(nil)
+
+	if proc.env.getenv(sentinelEnvVar) == "" {
+		t.Error("Child doesn't have a parent")
+	}
+}
@@ -0,0 +1,317 @@
+//go:build !windows
+// +build !windows
+
+// Command tableflipctl triggers and inspects upgrades of processes
+// using tableflip.
+//
+// The process is either identified by a PID file, as written by
+// Options.PIDFile, by a status file, as written by Options.StatusFile,
+// or by a control socket, as served if Options.ControlSocket is set:
+//
+//	tableflipctl -pid-file /run/app.pid upgrade
+//	tableflipctl -status-file /run/app.json upgrade|status
+//	tableflipctl -socket /run/app.sock upgrade|status|stop|list-fds
+//
+// An upgrade waits until a new process has become ready, and exits
+// non-zero if the upgrade fails or doesn't finish within -timeout.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+)
+
+// pollInterval is the time between checks for the new process.
+const pollInterval = 100 * time.Millisecond
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+func main() {
+	var (
+		pidFile    = flag.String("pid-file", "", "`path` of the PID file written by the process")
+		statusFile = flag.String("status-file", "", "`path` of the status file written by the process")
+		socket     = flag.String("socket", "", "`path` of the control socket served by the process")
+		sigName    = flag.String("signal", "HUP", "signal which triggers an upgrade, unless -socket is used")
+		timeout    = flag.Duration("timeout", time.Minute, "maximum time to wait for the command to finish")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s (-pid-file path | -status-file path | -socket path) command\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands: upgrade, status, stop, list-fds (the latter two require -socket)")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var modes int
+	for _, path := range []string{*pidFile, *statusFile, *socket} {
+		if path != "" {
+			modes++
+		}
+	}
+	if flag.NArg() != 1 || modes != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(*sigName), "SIG")]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "tableflipctl: unsupported signal", *sigName)
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case *socket != "":
+		err = runSocket(*socket, flag.Arg(0), *timeout)
+	case *statusFile != "":
+		err = runStatusFile(*statusFile, flag.Arg(0), sig, *timeout)
+	default:
+		err = runPIDFile(*pidFile, flag.Arg(0), sig, *timeout)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tableflipctl:", err)
+		os.Exit(1)
+	}
+}
+
+func runSocket(path, command string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	if command != tableflip.ControlUpgrade {
+		resp, err := control(path, command, deadline)
+		if err != nil {
+			return err
+		}
+
+		var out interface{}
+		switch {
+		case resp.Status != nil:
+			out = resp.Status
+		case resp.Fds != nil:
+			out = resp.Fds
+		default:
+			return nil
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	before, err := status(path, deadline)
+	if err != nil {
+		return err
+	}
+
+	if _, err := control(path, tableflip.ControlUpgrade, deadline); err != nil {
+		return err
+	}
+
+	// The old process may still accept connections on the socket
+	// for a short while after the upgrade.
+	for {
+		after, err := status(path, deadline)
+		if err == nil && after.PID != before.PID && after.Ready {
+			fmt.Printf("upgraded pid %d to pid %d (generation %d)\n", before.PID, after.PID, after.Generation)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("upgrade succeeded, but the new process isn't serving %s after %s", path, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func status(path string, deadline time.Time) (*tableflip.ControlStatusResult, error) {
+	resp, err := control(path, tableflip.ControlStatus, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, errors.New("status is missing from response")
+	}
+	return resp.Status, nil
+}
+
+func control(path, command string, deadline time.Time) (*tableflip.ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(tableflip.ControlRequest{Command: command}); err != nil {
+		return nil, fmt.Errorf("can't send %s: %s", command, err)
+	}
+
+	var resp tableflip.ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, fmt.Errorf("%s timed out", command)
+		}
+		return nil, fmt.Errorf("can't read response to %s: %s", command, err)
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s failed: %s", command, resp.Error)
+	}
+	return &resp, nil
+}
+
+func runPIDFile(path, command string, sig syscall.Signal, timeout time.Duration) error {
+	pid, err := readPID(path)
+	if err != nil {
+		return err
+	}
+
+	if !isAlive(pid) {
+		return fmt.Errorf("process %d from %s isn't running", pid, path)
+	}
+
+	switch command {
+	case tableflip.ControlStatus:
+		fmt.Printf("pid %d is running\n", pid)
+		return nil
+
+	case tableflip.ControlUpgrade:
+	default:
+		return fmt.Errorf("%s requires -socket", command)
+	}
+
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("can't signal process %d: %s", pid, err)
+	}
+
+	// The PID file is written once the new process is ready.
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(pollInterval)
+
+		newPID, err := readPID(path)
+		if err == nil && newPID != pid && isAlive(newPID) {
+			fmt.Printf("upgraded pid %d to pid %d\n", pid, newPID)
+			return nil
+		}
+
+		if !isAlive(pid) {
+			// The old process exits right after the new one has
+			// written the PID file.
+			newPID, err := readPID(path)
+			if err != nil || newPID == pid {
+				return fmt.Errorf("process %d exited without an upgrade", pid)
+			}
+			if !isAlive(newPID) {
+				return fmt.Errorf("process %d exited, and new process %d exited as well", pid, newPID)
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no new process became ready within %s, process %d is still running and should log why the upgrade failed", timeout, pid)
+		}
+	}
+}
+
+func runStatusFile(path, command string, sig syscall.Signal, timeout time.Duration) error {
+	status, err := readStatus(path)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case tableflip.ControlStatus:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+
+	case tableflip.ControlUpgrade:
+	default:
+		return fmt.Errorf("%s requires -socket", command)
+	}
+
+	if status.State != tableflip.StateReady && status.State != tableflip.StateUpgradeFailed {
+		return fmt.Errorf("process %d is in state %s", status.PID, status.State)
+	}
+
+	if err := syscall.Kill(status.PID, sig); err != nil {
+		return fmt.Errorf("can't signal process %d: %s", status.PID, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(pollInterval)
+
+		current, err := readStatus(path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case current.State == tableflip.StateReady && current.PID != status.PID:
+			fmt.Printf("upgraded pid %d to pid %d (generation %d)\n", status.PID, current.PID, current.Generation)
+			return nil
+
+		case current.State == tableflip.StateUpgradeFailed && current.Updated.After(status.Updated):
+			return fmt.Errorf("upgrade failed: %s", current.Error)
+
+		case current.State == tableflip.StateStopped:
+			return fmt.Errorf("process %d stopped without an upgrade", current.PID)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("upgrade didn't finish within %s, process %d is in state %s", timeout, current.PID, current.State)
+		}
+	}
+}
+
+func readStatus(path string) (*tableflip.Status, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read status file: %s", err)
+	}
+
+	var status tableflip.Status
+	if err := json.Unmarshal(buf, &status); err != nil {
+		return nil, fmt.Errorf("invalid status file %s: %s", path, err)
+	}
+	return &status, nil
+}
+
+func readPID(path string) (int, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("can't read PID file: %s", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid PID file %s: %s", path, err)
+	}
+	return pid, nil
+}
+
+func isAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,228 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+)
+
+func writePIDFile(t *testing.T, path string, pid int) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pid")
+	writePIDFile(t, path, os.Getpid())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	go func() {
+		<-sig
+		// Pretend that our parent is the new process.
+		writePIDFile(t, path, os.Getppid())
+	}()
+
+	if err := runPIDFile(path, tableflip.ControlUpgrade, syscall.SIGUSR1, 5*time.Second); err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+}
+
+func TestRunPIDFileTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pid")
+	writePIDFile(t, path, os.Getpid())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	err := runPIDFile(path, tableflip.ControlUpgrade, syscall.SIGUSR1, 300*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Fatal("Expected a timeout, got", err)
+	}
+}
+
+func TestRunPIDFileNewProcessExited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pid")
+
+	// A PID which isn't alive anymore.
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	deadPID := exited.Process.Pid
+
+	// The old process writes the PID of the crashed new process
+	// and exits.
+	old := exec.Command("sh", "-c", `trap 'echo `+strconv.Itoa(deadPID)+` > "$0"; exit 0' USR1; echo ready; while :; do sleep 0.01; done`, path)
+	stdout, err := old.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		old.Wait()
+		close(done)
+	}()
+	defer func() {
+		old.Process.Kill()
+		<-done
+	}()
+
+	if _, err := stdout.Read(make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	writePIDFile(t, path, old.Process.Pid)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- runPIDFile(path, tableflip.ControlUpgrade, syscall.SIGUSR1, time.Minute)
+	}()
+
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "new process "+strconv.Itoa(deadPID)+" exited") {
+			t.Fatal("Expected the new process to be reported as exited, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runPIDFile doesn't notice that the new process exited")
+	}
+}
+
+// fakeControl serves the control protocol, and upgrades to newPID
+// unless upgradeErr is set.
+func fakeControl(t *testing.T, newPID int, upgradeErr string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "socket")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		pid := 1
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			var req tableflip.ControlRequest
+			_ = json.NewDecoder(conn).Decode(&req)
+
+			var resp tableflip.ControlResponse
+			switch req.Command {
+			case tableflip.ControlStatus:
+				resp.Status = &tableflip.ControlStatusResult{PID: pid, Ready: true}
+			case tableflip.ControlUpgrade:
+				if upgradeErr != "" {
+					resp.Error = upgradeErr
+				} else {
+					pid = newPID
+				}
+			}
+
+			_ = json.NewEncoder(conn).Encode(resp)
+			conn.Close()
+		}
+	}()
+
+	return path
+}
+
+func TestRunSocket(t *testing.T) {
+	path := fakeControl(t, 2, "")
+
+	if err := runSocket(path, tableflip.ControlUpgrade, 5*time.Second); err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+}
+
+func TestRunSocketUpgradeFails(t *testing.T) {
+	path := fakeControl(t, 2, "child exited")
+
+	err := runSocket(path, tableflip.ControlUpgrade, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "child exited") {
+		t.Fatal("Expected the error from Upgrade, got", err)
+	}
+}
+
+func writeStatus(t *testing.T, path string, status tableflip.Status) {
+	t.Helper()
+
+	data, err := json.Marshal(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the file atomically, like the Upgrader does.
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStatusFile(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		after  tableflip.Status
+		errMsg string
+	}{
+		{"success", tableflip.Status{PID: os.Getppid(), State: tableflip.StateReady}, ""},
+		{"failure", tableflip.Status{PID: os.Getpid(), State: tableflip.StateUpgradeFailed, Error: "child exited"}, "child exited"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "status")
+			writeStatus(t, path, tableflip.Status{
+				PID:     os.Getpid(),
+				State:   tableflip.StateReady,
+				Updated: time.Now().Add(-time.Second),
+			})
+
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGUSR1)
+			defer signal.Stop(sig)
+
+			go func() {
+				<-sig
+				after := test.after
+				after.Updated = time.Now()
+				writeStatus(t, path, after)
+			}()
+
+			err := runStatusFile(path, tableflip.ControlUpgrade, syscall.SIGUSR1, 5*time.Second)
+			if test.errMsg == "" {
+				if err != nil {
+					t.Fatal("Upgrade failed:", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Fatalf("Expected error containing %q, got %v", test.errMsg, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+// Command tableflipctl triggers and inspects upgrades of processes
+// using tableflip.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, "tableflipctl: graceful restarts aren't supported on Windows")
+	os.Exit(1)
+}
@@ -0,0 +1,174 @@
+package tableflip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Commands understood by the control socket.
+const (
+	// ControlUpgrade calls Upgrade, see Upgrader.SetUpgradeOptions.
+	ControlUpgrade = "upgrade"
+	ControlStatus  = "status"
+	ControlStop    = "stop"
+	ControlListFds = "list-fds"
+)
+
+// controlReadTimeout limits how long the control server waits
+// for a request.
+const controlReadTimeout = 10 * time.Second
+
+// ControlRequest is sent to the control socket as a single JSON object.
+type ControlRequest struct {
+	Command string `json:"command"`
+}
+
+// ControlResponse is returned by the control socket as a single JSON
+// object, once the command has finished.
+type ControlResponse struct {
+	// Error is empty if the command succeeded.
+	Error string `json:"error,omitempty"`
+	// Status is set for ControlStatus.
+	Status *ControlStatusResult `json:"status,omitempty"`
+	// Fds is set for ControlListFds.
+	Fds []ControlFd `json:"fds,omitempty"`
+}
+
+// ControlStatusResult describes the process serving the control socket.
+type ControlStatusResult struct {
+	PID           int       `json:"pid"`
+	Generation    int       `json:"generation"`
+	StartTime     time.Time `json:"start_time"`
+	ParentPID     int       `json:"parent_pid,omitempty"`
+	ParentVersion string    `json:"parent_version,omitempty"`
+	Version       string    `json:"version,omitempty"`
+	Ready         bool      `json:"ready"`
+}
+
+// ControlFd describes a file descriptor known to the process serving
+// the control socket.
+type ControlFd struct {
+	Kind    string `json:"kind"`
+	Network string `json:"network,omitempty"`
+	// Address is the name for fds added via AddFile.
+	Address string `json:"address,omitempty"`
+	// Used is false for fds which were inherited, but haven't been
+	// used yet.
+	Used bool `json:"used"`
+}
+
+func (u *Upgrader) listenControl(path string) error {
+	ln, err := u.Fds.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("tableflip: can't listen on control socket: %s", err)
+	}
+
+	go func() {
+		// Only serve once ready, so that requests don't reach a new
+		// process while the parent is still running.
+		select {
+		case <-u.readyC:
+		case <-u.exitC:
+			ln.Close()
+			return
+		}
+
+		go u.serveControl(ln)
+
+		// The new process takes over the control socket.
+		<-u.exitC
+		ln.Close()
+	}()
+	return nil
+}
+
+func (u *Upgrader) serveControl(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// The listener was closed.
+			return
+		}
+
+		go u.handleControl(conn)
+	}
+}
+
+func (u *Upgrader) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(controlReadTimeout))
+
+	var req ControlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		u.logger.Warn("invalid control request", "error", err)
+		return
+	}
+
+	u.logger.Info("received control request", "command", req.Command)
+	resp := u.control(req)
+	if resp.Error != "" {
+		u.logger.Warn("control request failed", "command", req.Command, "error", resp.Error)
+	}
+
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+func (u *Upgrader) control(req ControlRequest) ControlResponse {
+	switch req.Command {
+	case ControlUpgrade:
+		if err := u.Upgrade(); err != nil {
+			return ControlResponse{Error: err.Error()}
+		}
+		return ControlResponse{}
+
+	case ControlStop:
+		u.Stop()
+		return ControlResponse{}
+
+	case ControlStatus:
+		lineage := u.Lineage()
+
+		var ready bool
+		select {
+		case <-u.readyC:
+			ready = true
+		default:
+		}
+
+		return ControlResponse{Status: &ControlStatusResult{
+			PID:           os.Getpid(),
+			Generation:    lineage.Generation,
+			StartTime:     lineage.StartTime,
+			ParentPID:     lineage.ParentPID,
+			ParentVersion: lineage.ParentVersion,
+			Version:       u.opts.Version,
+			Ready:         ready,
+		}}
+
+	case ControlListFds:
+		inherited, used := u.Fds.names()
+
+		fds := make([]ControlFd, 0, len(inherited)+len(used))
+		for _, name := range used {
+			fds = append(fds, newControlFd(name, true))
+		}
+		for _, name := range inherited {
+			fds = append(fds, newControlFd(name, false))
+		}
+		return ControlResponse{Fds: fds}
+
+	default:
+		return ControlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+}
+
+func newControlFd(name fileName, used bool) ControlFd {
+	if name[0] == fdKind {
+		return ControlFd{name[0], "", name[1], used}
+	}
+	return ControlFd{name[0], name[1], name[2], used}
+}
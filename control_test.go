@@ -0,0 +1,238 @@
+package tableflip
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendControl(t *testing.T, path, command string) ControlResponse {
+	t.Helper()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(ControlRequest{command}); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal("Can't decode response:", err)
+	}
+	return resp
+}
+
+func TestControlStatus(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath, Version: "v1"})
+	defer u.Stop()
+
+	resp := sendControl(t, socketPath, ControlStatus)
+	if resp.Error != "" {
+		t.Fatal("Status failed:", resp.Error)
+	}
+	if resp.Status == nil {
+		t.Fatal("Status is missing")
+	}
+	if resp.Status.Generation != 1 || resp.Status.Version != "v1" || !resp.Status.Ready {
+		t.Error("Unexpected status:", *resp.Status)
+	}
+}
+
+func TestControlListFds(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath})
+	defer u.Stop()
+
+	resp := sendControl(t, socketPath, ControlListFds)
+	if resp.Error != "" {
+		t.Fatal("list-fds failed:", resp.Error)
+	}
+
+	want := ControlFd{listenKind, "unix", socketPath, true}
+	if len(resp.Fds) != 1 || resp.Fds[0] != want {
+		t.Errorf("Expected %v, got %v", want, resp.Fds)
+	}
+}
+
+func TestControlListFdsFile(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath})
+	defer u.Stop()
+
+	if err := u.AddFile("stdin", os.Stdin); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := sendControl(t, socketPath, ControlListFds)
+	want := ControlFd{Kind: fdKind, Address: "stdin", Used: true}
+	if len(resp.Fds) != 2 || resp.Fds[0] != want {
+		t.Errorf("Expected %v, got %v", want, resp.Fds)
+	}
+}
+
+func TestControlWaitsForReady(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	env, _ := testEnv()
+	u, err := newUpgrader(env, Options{ControlSocket: socketPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(ControlRequest{ControlStatus}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Control socket is served before Ready")
+	}
+
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal("Control socket isn't served after Ready:", err)
+	}
+	if resp.Status == nil || !resp.Status.Ready {
+		t.Error("Unexpected status:", resp)
+	}
+}
+
+func TestControlUpgrade(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath})
+	defer u.Stop()
+
+	resps := make(chan ControlResponse, 1)
+	go func() {
+		for {
+			resp := sendControl(t, socketPath, ControlUpgrade)
+			if resp.Error != errNotReady.Error() {
+				resps <- resp
+				return
+			}
+		}
+	}()
+
+	proc := <-u.procs
+	proc.exit(errors.New("some error"))
+
+	resp := <-resps
+	if !strings.Contains(resp.Error, "some error") {
+		t.Error("Expected the error from Upgrade, got", resp.Error)
+	}
+}
+
+func TestControlStop(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath})
+	defer u.Stop()
+
+	if resp := sendControl(t, socketPath, ControlStop); resp.Error != "" {
+		t.Fatal("Stop failed:", resp.Error)
+	}
+
+	select {
+	case <-u.Exit():
+	case <-time.After(time.Second):
+		t.Fatal("Stop command doesn't stop the Upgrader")
+	}
+}
+
+func TestControlUnknownCommand(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath})
+	defer u.Stop()
+
+	if resp := sendControl(t, socketPath, "foo"); resp.Error == "" {
+		t.Error("Unknown command doesn't return an error")
+	}
+}
+
+func TestControlInherited(t *testing.T) {
+	t.Parallel()
+
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	u := newTestUpgrader(Options{ControlSocket: socketPath})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{ControlSocket: socketPath})
+	if err != nil {
+		t.Fatal("Can't inherit control socket:", err)
+	}
+	defer child.Stop()
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+	<-u.Exit()
+
+	// The old process might still accept a connection before it
+	// closes the control socket.
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp := sendControl(t, socketPath, ControlStatus)
+		if resp.Status != nil && resp.Status.Generation == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("New process doesn't serve the control socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,6 +1,6 @@
 // Package tableflip implements zero downtime upgrades.
 //
-// An upgrade spawns a new copy of argv[0] and passes
+// An upgrade spawns a new process, by default a copy of argv[0], and passes
 // file descriptors of used listening sockets to the new process. The old process exits
 // once the new process signals readiness. Thus new code can use sockets allocated
 // in the old process. This is similar to the approach used by nginx, but
@@ -29,10 +29,31 @@
 // systemd-run will print a unit name, which you can use with systemctl to
 // inspect the service.
 //
-// NOTES:
+// Alternatively, the Upgrader supports the sd_notify protocol if NOTIFY_SOCKET
+// is set. It sends READY=1 and MAINPID from Ready, RELOADING=1 when an upgrade
+// starts and STOPPING=1 on Stop. This avoids racing systemd's polling of the
+// PID file. Since notifications are sent from the new process, NotifyAccess
+// has to be set to all.
+//
+//    [Service]
+//    Type=notify
+//    NotifyAccess=all
+//    ExecStart=/path/to/binary -some-flag
+//    ExecReload=/bin/kill -HUP $MAINPID
 //
-// Requires at least Go 1.9, since there is a race condition on the
-// pipes used for communication between parent and child.
+// Sockets passed via socket activation (LISTEN_FDS) are inherited by the first
+// generation. They are returned by Fds.Listen and friends if network and
+// address match the bound address of the socket, with unspecified IP
+// addresses omitted, e.g. ":80". Other file descriptors are available via
+// Fds.File, using their name from LISTEN_FDNAMES. Paths of activated Unix
+// sockets are never unlinked, since they belong to the socket unit.
+//
+// If Options.FDStore is set, all used file descriptors are pushed into the
+// file descriptor store of systemd when Ready is called. This requires
+// FileDescriptorStoreMax to be set in the unit file. If the process crashes,
+// systemd passes the stored descriptors back when restarting the service.
+//
+// NOTES:
 //
 // If you're seeing "can't start process: no such file or directory",
 // you're probably using "go run main.go", for graceful reloads to work,
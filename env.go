@@ -5,9 +5,10 @@ import (
 )
 
 type env struct {
-	newProc     func(string, []string, []*os.File, []string) (process, error)
+	newProc     func(executable string, args []string, dir string, files []*os.File, env []string) (process, error)
 	newFile     func(fd uintptr, name string) *os.File
 	environ     func() []string
 	getenv      func(string) string
 	closeOnExec func(fd int)
+	signal      func(pid int, sig os.Signal) error
 }
@@ -14,4 +14,5 @@ var stdEnv = &env{
 	environ:     os.Environ,
 	getenv:      os.Getenv,
 	closeOnExec: syscall.CloseOnExec,
+	signal:      signalPID,
 }
@@ -7,11 +7,12 @@ import (
 func testEnv() (*env, chan *testProcess) {
 	procs := make(chan *testProcess, 10)
 	return &env{
-		newProc: func(_ string, _ []string, files []*os.File, env []string) (process, error) {
+		newProc: func(executable string, args []string, dir string, files []*os.File, env []string) (process, error) {
 			p, err := newTestProcess(files, env)
 			if err != nil {
 				return nil, err
 			}
+			p.executable, p.args, p.dir = executable, args, dir
 			procs <- p
 			return p, nil
 		},
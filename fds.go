@@ -3,9 +3,11 @@ package tableflip
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -34,6 +36,7 @@ const (
 	packetKind = "packet"
 	connKind   = "conn"
 	fdKind     = "fd"
+	lockKind   = "lock"
 )
 
 type fileName [3]string
@@ -42,6 +45,17 @@ func (name fileName) String() string {
 	return strings.Join(name[:], ":")
 }
 
+// activatedKey is the metadata key set on sockets passed via systemd
+// socket activation.
+const activatedKey = "systemd-activated"
+
+// removable returns whether the Unix socket of file may be unlinked from
+// the file system. Paths of sockets passed via socket activation belong
+// to the systemd socket unit, and are never unlinked.
+func (name fileName) removable(file *file) bool {
+	return name.isUnix() && file.meta[activatedKey] == ""
+}
+
 func (name fileName) isUnix() bool {
 	if name[0] == listenKind && (name[1] == "unix" || name[1] == "unixpacket") {
 		return true
@@ -52,12 +66,32 @@ func (name fileName) isUnix() bool {
 	return false
 }
 
+// fileAddr is the address of a listener passed to another process.
+type fileAddr struct {
+	network, address string
+}
+
+func (fa fileAddr) Network() string { return fa.network }
+func (fa fileAddr) String() string  { return fa.address }
+
+func listenerAddrs(files map[fileName]*file) []net.Addr {
+	var addrs []net.Addr
+	for key := range files {
+		if key[0] == listenKind {
+			addrs = append(addrs, fileAddr{key[1], key[2]})
+		}
+	}
+	return addrs
+}
+
 // file works around the fact that it's not possible
 // to get the fd from an os.File without putting it into
 // blocking mode.
 type file struct {
 	*os.File
 	fd uintptr
+	// Metadata passed along with the file during an upgrade.
+	meta map[string]string
 }
 
 func newFile(fd uintptr, name fileName) *file {
@@ -69,6 +103,7 @@ func newFile(fd uintptr, name fileName) *file {
 	return &file{
 		f,
 		fd,
+		nil,
 	}
 }
 
@@ -89,6 +124,16 @@ type Fds struct {
 	inherited map[fileName]*file
 	used      map[fileName]*file
 	lc        *net.ListenConfig
+	// passed contains all fds inherited from the parent, used or not.
+	passed map[fileName]*file
+	logger *slog.Logger
+	// conns counts the open connections of all tracked listeners.
+	conns connCounter
+	// tracked is true once ListenTracked was called.
+	tracked bool
+	// fdStore is used to remove fds from the systemd file descriptor
+	// store, or nil if Options.FDStore isn't set.
+	fdStore *env
 }
 
 func newFds(inherited map[fileName]*file, lc *net.ListenConfig) *Fds {
@@ -100,11 +145,34 @@ func newFds(inherited map[fileName]*file, lc *net.ListenConfig) *Fds {
 		lc = &net.ListenConfig{}
 	}
 
+	passed := make(map[fileName]*file, len(inherited))
+	for key, file := range inherited {
+		passed[key] = file
+	}
+
 	return &Fds{
 		inherited: inherited,
 		used:      make(map[fileName]*file),
 		lc:        lc,
+		passed:    passed,
+		logger:    discardLogger,
+	}
+}
+
+// counts returns the number of used fds which were inherited or created,
+// and the number of inherited fds which haven't been used.
+func (f *Fds) counts() (inherited, created, unused int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, file := range f.used {
+		if f.passed[key] == file {
+			inherited++
+		} else {
+			created++
+		}
 	}
+	return inherited, created, len(f.inherited)
 }
 
 func (f *Fds) newListener(network, addr string) (net.Listener, error) {
@@ -112,10 +180,37 @@ func (f *Fds) newListener(network, addr string) (net.Listener, error) {
 }
 
 // Listen returns a listener inherited from the parent process, or creates a new one.
+//
+// Use ListenTracked to keep track of accepted connections.
 func (f *Fds) Listen(network, addr string) (net.Listener, error) {
 	return f.ListenWithCallback(network, addr, f.newListener)
 }
 
+// ListenTracked is like Listen, but returns a listener which tracks
+// accepted connections. The number of open connections of all tracked
+// listeners is reported to the new process after an upgrade, see
+// Upgrader.ParentConns.
+func (f *Fds) ListenTracked(network, addr string) (*TrackedListener, error) {
+	ln, err := f.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tracked = true
+	return &TrackedListener{Listener: ln.(Listener), total: &f.conns}, nil
+}
+
+// isTracked returns true if any tracked listeners were created.
+func (f *Fds) isTracked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.tracked
+}
+
 // ListenWithCallback returns a listener inherited from the parent process,
 // or calls the supplied callback to create a new one.
 //
@@ -417,33 +512,251 @@ func (f *Fds) AddFile(name string, file *os.File) error {
 	return nil
 }
 
+// setMeta sets the metadata k of the used file called key, if it exists.
+func (f *Fds) setMeta(key fileName, k, v string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file := f.used[key]
+	if file == nil {
+		return
+	}
+
+	// Replace meta instead of modifying it, since it may be shared with
+	// copies of file.
+	meta := make(map[string]string, len(file.meta)+1)
+	for mk, mv := range file.meta {
+		meta[mk] = mv
+	}
+	meta[k] = v
+	file.meta = meta
+}
+
 func (f *Fds) copy() map[fileName]*file {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	files := make(map[fileName]*file, len(f.used))
 	for key, file := range f.used {
-		files[key] = file
+		// Copy the struct, since meta may be replaced concurrently.
+		copied := *file
+		files[key] = &copied
 	}
 
 	return files
 }
 
+// lockPIDFile takes an exclusive lock next to the PID file at path,
+// unless the lock was inherited from the parent. The lock is passed on
+// to the next generation.
+func (f *Fds) lockPIDFile(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := fileName{lockKind, path + ".lock"}
+	if file := f.inherited[key]; file != nil {
+		delete(f.inherited, key)
+		f.used[key] = file
+		return nil
+	}
+
+	file, err := lockFile(key[1])
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		f.used[key] = file
+	}
+	return nil
+}
+
+// Descriptor describes a file descriptor held by Fds.
+type Descriptor struct {
+	// Kind is one of "listener", "packet", "conn" or "fd" for descriptors
+	// added by the application. Other kinds are used internally.
+	Kind string
+	// Network of the socket, e.g. "tcp". Empty for Kind "fd".
+	Network string
+	// Addr is the address of the socket, or the name of the file for
+	// Kind "fd". Together with Network it can be passed to Listener
+	// and friends.
+	Addr string
+	// Fd is the number of the descriptor in the current process.
+	Fd uintptr
+	// SocketType is the type of the socket, e.g. syscall.SOCK_STREAM.
+	// Zero if the descriptor isn't a socket, or the type is unknown.
+	SocketType int
+	// ReuseAddr and ReusePort are true if SO_REUSEADDR or SO_REUSEPORT
+	// are set on the socket.
+	ReuseAddr, ReusePort bool
+}
+
+func newDescriptor(key fileName, file *file) Descriptor {
+	d := Descriptor{
+		Kind:    key[0],
+		Network: key[1],
+		Addr:    key[2],
+		Fd:      file.fd,
+	}
+	if key[0] == fdKind {
+		d.Network, d.Addr = "", key[1]
+	}
+	d.SocketType, d.ReuseAddr, d.ReusePort = socketOptions(file.fd)
+	return d
+}
+
+// Inherited returns the descriptors passed by the parent which haven't
+// been used yet, sorted by kind, network and address. Unused descriptors
+// are closed by Upgrader.Ready, after which the list is empty.
+//
+// This allows reconciling configuration with the descriptors received
+// from the parent.
+func (f *Fds) Inherited() []Descriptor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return descriptors(f.inherited)
+}
+
+// Used returns the descriptors which are passed to the next process,
+// sorted by kind, network and address.
+func (f *Fds) Used() []Descriptor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return descriptors(f.used)
+}
+
+func descriptors(files map[fileName]*file) []Descriptor {
+	keys := make([]fileName, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sortFileNames(keys)
+
+	ds := make([]Descriptor, 0, len(keys))
+	for _, key := range keys {
+		ds = append(ds, newDescriptor(key, files[key]))
+	}
+	return ds
+}
+
+// Remove closes the descriptor identified by kind, network and addr, as
+// returned by Inherited and Used, so that it isn't passed to new
+// processes anymore. If Options.FDStore is set, it's also removed from
+// the systemd file descriptor store.
+//
+// Listeners and connections returned by Fds keep working until they
+// are closed. Unix sockets are the exception: they are unlinked from the
+// file system immediately, so no new clients can connect to them. Sockets
+// passed via socket activation are never unlinked, since their paths
+// belong to the systemd socket unit.
+func (f *Fds) Remove(kind, network, addr string) error {
+	var key fileName
+	switch kind {
+	case listenKind, packetKind, connKind:
+		key = fileName{kind, network, addr}
+	case fdKind:
+		key = fileName{kind, addr}
+	default:
+		return fmt.Errorf("tableflip: can't remove descriptor of kind %q", kind)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file := f.used[key]
+	if file != nil {
+		delete(f.used, key)
+	} else if file = f.inherited[key]; file != nil {
+		delete(f.inherited, key)
+	} else {
+		return fmt.Errorf("tableflip: unknown descriptor %s", key)
+	}
+
+	f.logger.Info("removing fd", "name", key.String())
+	if key.removable(file) {
+		f.unlinkUnixSocket(key[2])
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if f.fdStore != nil {
+		if err := sdRemoveFd(f.fdStore, key); err != nil {
+			return fmt.Errorf("tableflip: can't remove %s from fd store: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// RemoveListener removes a listener, see Remove.
+func (f *Fds) RemoveListener(network, addr string) error {
+	return f.Remove(listenKind, network, addr)
+}
+
+// RemovePacketConn removes a packet connection, see Remove.
+func (f *Fds) RemovePacketConn(network, addr string) error {
+	return f.Remove(packetKind, network, addr)
+}
+
+// RemoveConn removes a connection, see Remove.
+func (f *Fds) RemoveConn(network, addr string) error {
+	return f.Remove(connKind, network, addr)
+}
+
+// RemoveFile removes a file, see Remove.
+func (f *Fds) RemoveFile(name string) error {
+	return f.Remove(fdKind, "", name)
+}
+
+// names returns the sorted names of all inherited but unused,
+// and of all used fds.
+func (f *Fds) names() (inherited, used []fileName) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key := range f.inherited {
+		inherited = append(inherited, key)
+	}
+	for key := range f.used {
+		used = append(used, key)
+	}
+	sortFileNames(inherited)
+	sortFileNames(used)
+	return inherited, used
+}
+
+func sortFileNames(names []fileName) {
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+}
+
 func (f *Fds) closeInherited() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	for key, file := range f.inherited {
-		if key.isUnix() {
+		f.logger.Info("closing unused inherited fd", "name", key.String())
+		if key.removable(file) {
 			// Remove inherited but unused Unix sockets from the file system.
 			// This undoes the effect of SetUnlinkOnClose(false).
-			_ = unlinkUnixSocket(key[2])
+			f.unlinkUnixSocket(key[2])
 		}
 		_ = file.Close()
 	}
 	f.inherited = make(map[fileName]*file)
 }
 
+func (f *Fds) unlinkUnixSocket(path string) {
+	if err := unlinkUnixSocket(path); err != nil {
+		f.logger.Warn("can't unlink Unix socket", "path", path, "error", err)
+		return
+	}
+	f.logger.Debug("unlinked Unix socket", "path", path)
+}
+
 func unlinkUnixSocket(path string) error {
 	if runtime.GOOS == "linux" && strings.HasPrefix(path, "@") {
 		// Don't unlink sockets using the abstract namespace.
@@ -472,16 +785,32 @@ func (f *Fds) closeUsed() {
 	f.used = make(map[fileName]*file)
 }
 
+// closeAll closes all fds without unlinking Unix sockets, since they
+// may still be used by the parent.
+func (f *Fds) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, file := range f.inherited {
+		_ = file.Close()
+	}
+	for _, file := range f.used {
+		_ = file.Close()
+	}
+	f.inherited = make(map[fileName]*file)
+	f.used = make(map[fileName]*file)
+}
+
 func (f *Fds) closeAndRemoveUsed() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	for key, file := range f.used {
-		if key.isUnix() {
+		if key.removable(file) {
 			// Remove used Unix Domain Sockets if we are shutting
 			// down without having done an upgrade.
 			// This undoes the effect of SetUnlinkOnClose(false).
-			_ = unlinkUnixSocket(key[2])
+			f.unlinkUnixSocket(key[2])
 		}
 		_ = file.Close()
 	}
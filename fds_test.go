@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"testing"
 )
 
@@ -455,3 +456,121 @@ func TestFdsFiles(t *testing.T) {
 		ff.Close()
 	}
 }
+
+func TestFdsDescriptors(t *testing.T) {
+	parent := newFds(nil, nil)
+
+	ln, err := parent.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	conn, err := parent.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	if err := parent.AddFile("pipe", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parent.Inherited()) != 0 {
+		t.Error("Fds without parent has inherited descriptors")
+	}
+
+	child := newFds(parent.copy(), nil)
+	inherited := child.Inherited()
+	if len(inherited) != 3 {
+		t.Fatalf("Expected 3 inherited descriptors, got %v", inherited)
+	}
+
+	fd, ln2, pc := inherited[0], inherited[1], inherited[2]
+	if fd.Kind != "fd" || fd.Addr != "pipe" || fd.Network != "" || fd.SocketType != 0 {
+		t.Errorf("Unexpected descriptor for file: %+v", fd)
+	}
+	if ln2.Kind != "listener" || ln2.Network != "tcp" || ln2.Addr != addr || ln2.SocketType != syscall.SOCK_STREAM {
+		t.Errorf("Unexpected descriptor for listener: %+v", ln2)
+	}
+	if pc.Kind != "packet" || pc.Network != "udp" || pc.SocketType != syscall.SOCK_DGRAM {
+		t.Errorf("Unexpected descriptor for packet conn: %+v", pc)
+	}
+
+	ln3, err := child.Listener(ln2.Network, ln2.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln3.Close()
+
+	if n := len(child.Inherited()); n != 2 {
+		t.Error("Expected 2 inherited descriptors after using one, got", n)
+	}
+
+	used := child.Used()
+	if len(used) != 1 || used[0] != ln2 {
+		t.Errorf("Expected %+v to be used, got %+v", ln2, used)
+	}
+}
+
+func TestFdsRemove(t *testing.T) {
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	fds := newFds(nil, nil)
+
+	unix, err := fds.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	tcp, err := fds.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	if err := fds.RemoveListener("unix", socketPath); err != nil {
+		t.Fatal("Can't remove listener:", err)
+	}
+
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Error("Remove doesn't unlink Unix socket:", err)
+	}
+
+	files := fds.copy()
+	if _, ok := files[fileName{listenKind, "unix", socketPath}]; ok {
+		t.Error("Removed listener is passed to new processes")
+	}
+	if len(files) != 1 {
+		t.Error("Expected one file to be passed, got", len(files))
+	}
+
+	if err := fds.RemoveListener("unix", socketPath); err == nil {
+		t.Error("Removing a listener twice doesn't return an error")
+	}
+
+	if err := fds.Remove(lockKind, "", socketPath); err == nil {
+		t.Error("Internal descriptors can be removed")
+	}
+
+	if err := fds.RemoveListener("tcp", tcp.Addr().String()); err != nil {
+		t.Fatal("Can't remove listener:", err)
+	}
+
+	// The listener returned by Fds keeps working.
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
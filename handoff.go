@@ -0,0 +1,53 @@
+package tableflip
+
+import (
+	"time"
+)
+
+const (
+	// handoffKind names the fd of the handoff message in the names sent
+	// by parents which speak version 2 or later of the protocol. Children
+	// which only understand version 1 treat it like any other inherited
+	// fd: it is closed on exec, and closed once they are ready.
+	handoffKind = "handoff"
+
+	// handoffVersion is the version of the handoff protocol implemented
+	// by this package. Version 1 is a bare gob encoded [][]string of
+	// names, with fds starting at 5. It is always sent, so that children
+	// built against version 1 keep working.
+	handoffVersion = 2
+)
+
+// handoff is sent from the parent to the child during an upgrade.
+//
+// Fields may be added, but never removed or changed, since gob ignores
+// fields unknown to the receiver.
+type handoff struct {
+	// Version of the protocol spoken by the parent.
+	Version int
+	// Generation of the child, starting at 1 for a process without
+	// a parent.
+	Generation int
+	// PID of the parent.
+	ParentPID int
+	// Time at which the parent started the upgrade.
+	Timestamp time.Time
+	// Time at which the first generation started.
+	StartTime time.Time
+	// Version of the parent, see Options.Version.
+	ParentVersion string
+	Files         []handoffFile
+	// Application state, see Upgrader.AddState.
+	State map[string][]byte
+	// ReportsFinished is true if the parent tells the child once the
+	// upgrade has finished, by sending upgradeFinished after the child
+	// accepted the number of open connections.
+	ReportsFinished bool
+}
+
+type handoffFile struct {
+	Name []string
+	// The fd in the child.
+	Fd   int
+	Meta map[string]string
+}
@@ -0,0 +1,84 @@
+package tableflip
+
+// Hooks are called at specific points in the life cycle of an Upgrader.
+// Any of them may be nil.
+//
+// Hooks are called one at a time from a single goroutine, which is
+// blocked until the hook returns. They may call Stop, but must not call
+// Upgrade or UpgradeWithOptions.
+//
+// During an upgrade hooks are called in the following order:
+// BeforeUpgrade, ChildStarted, ChildReady and ProbationStarted. If the
+// upgrade fails after BeforeUpgrade succeeded, UpgradeFailed is called last.
+type Hooks struct {
+	// BeforeUpgrade is called before the new process is started.
+	// Returning an error aborts the upgrade, and Upgrade returns an
+	// error wrapping it.
+	BeforeUpgrade func() error
+	// ChildStarted is called with the PID of the new process once
+	// it was started.
+	ChildStarted func(pid int)
+	// ChildReady is called once the new process has called Ready, before
+	// running the readiness probe or waiting for the probation period.
+	ChildReady func()
+	// ProbationStarted is called once the probation period begins, see
+	// Options.ProbationPeriod. The current process should stop accepting
+	// new connections, for example by pausing its accept loops, without
+	// closing its listeners. Since listening sockets are shared, new
+	// connections are then only accepted by the new process. If the
+	// new process exits during the period, UpgradeFailed is called and
+	// the current process should resume accepting.
+	ProbationStarted func()
+	// UpgradeFailed is called with the error returned by Upgrade, unless
+	// the upgrade was aborted by BeforeUpgrade.
+	UpgradeFailed func(err error)
+	// ParentExited is called in the new process once the parent has
+	// exited, with the same error as returned by WaitForParent.
+	ParentExited func(err error)
+	// Stopping is called after Stop, before closing fds. It isn't called
+	// if the process has been upgraded successfully.
+	Stopping func()
+}
+
+func (h *Hooks) beforeUpgrade() error {
+	if h.BeforeUpgrade == nil {
+		return nil
+	}
+	return h.BeforeUpgrade()
+}
+
+func (h *Hooks) childStarted(pid int) {
+	if h.ChildStarted != nil {
+		h.ChildStarted(pid)
+	}
+}
+
+func (h *Hooks) childReady() {
+	if h.ChildReady != nil {
+		h.ChildReady()
+	}
+}
+
+func (h *Hooks) probationStarted() {
+	if h.ProbationStarted != nil {
+		h.ProbationStarted()
+	}
+}
+
+func (h *Hooks) upgradeFailed(err error) {
+	if h.UpgradeFailed != nil {
+		h.UpgradeFailed(err)
+	}
+}
+
+func (h *Hooks) parentExited(err error) {
+	if h.ParentExited != nil {
+		h.ParentExited(err)
+	}
+}
+
+func (h *Hooks) stopping() {
+	if h.Stopping != nil {
+		h.Stopping()
+	}
+}
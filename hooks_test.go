@@ -0,0 +1,194 @@
+package tableflip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type hookRecorder struct {
+	events chan string
+}
+
+func newHookRecorder() (*hookRecorder, Hooks) {
+	hr := &hookRecorder{make(chan string, 10)}
+	return hr, Hooks{
+		BeforeUpgrade: func() error {
+			hr.events <- "BeforeUpgrade"
+			return nil
+		},
+		ChildStarted: func(pid int) {
+			hr.events <- fmt.Sprint("ChildStarted ", pid)
+		},
+		ChildReady: func() {
+			hr.events <- "ChildReady"
+		},
+		UpgradeFailed: func(err error) {
+			hr.events <- fmt.Sprint("UpgradeFailed ", err)
+		},
+		ParentExited: func(err error) {
+			hr.events <- fmt.Sprint("ParentExited ", err)
+		},
+		Stopping: func() {
+			hr.events <- "Stopping"
+		},
+	}
+}
+
+func (hr *hookRecorder) recorded() []string {
+	var events []string
+	for {
+		select {
+		case event := <-hr.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestHooksUpgrade(t *testing.T) {
+	t.Parallel()
+
+	hr, hooks := newHookRecorder()
+	u := newTestUpgrader(Options{Hooks: hooks})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+	if _, _, err := proc.notify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	<-u.Exit()
+	u.Stop()
+
+	want := []string{
+		"BeforeUpgrade",
+		fmt.Sprint("ChildStarted ", proc.PID()),
+		"ChildReady",
+	}
+	if events := hr.recorded(); !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected hooks %q, got %q", want, events)
+	}
+}
+
+func TestHooksUpgradeFailed(t *testing.T) {
+	t.Parallel()
+
+	hr, hooks := newHookRecorder()
+	u := newTestUpgrader(Options{Hooks: hooks})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+	proc.exit(errors.New("some error"))
+
+	err := <-errs
+	if err == nil {
+		t.Fatal("Upgrade doesn't return an error when the child exits")
+	}
+
+	want := []string{
+		"BeforeUpgrade",
+		fmt.Sprint("ChildStarted ", proc.PID()),
+		fmt.Sprint("UpgradeFailed ", err),
+	}
+	if events := hr.recorded(); !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected hooks %q, got %q", want, events)
+	}
+}
+
+func TestHooksBeforeUpgradeVeto(t *testing.T) {
+	t.Parallel()
+
+	veto := errors.New("veto")
+	var failed bool
+	u := newTestUpgrader(Options{Hooks: Hooks{
+		BeforeUpgrade: func() error {
+			return veto
+		},
+		UpgradeFailed: func(error) {
+			failed = true
+		},
+	}})
+	defer u.Stop()
+
+	err := errNotReady
+	for err == errNotReady {
+		err = u.Upgrade()
+	}
+	if !errors.Is(err, veto) {
+		t.Fatal("Expected Upgrade to return the veto, got", err)
+	}
+
+	select {
+	case <-u.procs:
+		t.Error("Vetoed upgrade started a new process")
+	default:
+	}
+
+	if failed {
+		t.Error("UpgradeFailed is called for a vetoed upgrade")
+	}
+}
+
+func TestHooksStopping(t *testing.T) {
+	t.Parallel()
+
+	hr, hooks := newHookRecorder()
+	u := newTestUpgrader(Options{Hooks: hooks})
+
+	u.Stop()
+	<-u.Exit()
+
+	want := []string{"Stopping"}
+	if events := hr.recorded(); !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected hooks %q, got %q", want, events)
+	}
+}
+
+func TestHooksParentExited(t *testing.T) {
+	t.Parallel()
+
+	env, procs := testEnv()
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hr, hooks := newHookRecorder()
+	proc := <-procs
+	u, err := newUpgrader(&proc.env, Options{Hooks: hooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	readyFile := <-child.ready
+	if err := readyFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-hr.events:
+		if event != "ParentExited <nil>" {
+			t.Error("Expected ParentExited hook, got", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ParentExited hook wasn't called")
+	}
+
+	if err := u.WaitForParent(context.Background()); err != nil {
+		t.Error("WaitForParent returned an error after the hook:", err)
+	}
+}
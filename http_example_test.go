@@ -70,7 +70,9 @@ func Example_httpShutdown() {
 
 	// Make sure to set a deadline on exiting the process
 	// after upg.Exit() is closed. No new upgrades can be
-	// performed if the parent doesn't exit.
+	// performed if the parent doesn't exit. Alternatively, set
+	// Options.ParentDrainTimeout to let the new process terminate
+	// the old one.
 	time.AfterFunc(30*time.Second, func() {
 		log.Println("Graceful shutdown timed out")
 		os.Exit(1)
@@ -0,0 +1,16 @@
+package tableflip
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops all records. It is used if Options.Logger is nil.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
@@ -0,0 +1,142 @@
+package tableflip
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+type recordingHandler struct {
+	mu      *sync.Mutex
+	records *[]map[string]slog.Value
+	attrs   []slog.Attr
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{
+		mu:      new(sync.Mutex),
+		records: new([]map[string]slog.Value),
+	}
+}
+
+func (rh *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (rh *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	record := map[string]slog.Value{
+		slog.MessageKey: slog.StringValue(r.Message),
+	}
+	for _, attr := range rh.attrs {
+		record[attr.Key] = attr.Value
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		record[attr.Key] = attr.Value
+		return true
+	})
+
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	*rh.records = append(*rh.records, record)
+	return nil
+}
+
+func (rh *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *rh
+	clone.attrs = append(append([]slog.Attr(nil), rh.attrs...), attrs...)
+	return &clone
+}
+
+func (rh *recordingHandler) WithGroup(string) slog.Handler {
+	return rh
+}
+
+func (rh *recordingHandler) find(msg string) map[string]slog.Value {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	for _, record := range *rh.records {
+		if record[slog.MessageKey].String() == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+func TestLoggerUpgrade(t *testing.T) {
+	t.Parallel()
+
+	rh := newRecordingHandler()
+	u := newTestUpgrader(Options{Logger: slog.New(rh)})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+	proc.exit(errors.New("some error"))
+	if err := <-errs; err == nil {
+		t.Fatal("Upgrade doesn't return an error when the child exits")
+	}
+
+	started := rh.find("started new process")
+	if started == nil {
+		t.Fatal("Spawning the child isn't logged")
+	}
+	if pid := started["child_pid"].Int64(); pid != int64(proc.PID()) {
+		t.Error("Expected child_pid", proc.PID(), "got", pid)
+	}
+	if gen := started["generation"].Int64(); gen != 1 {
+		t.Error("Expected generation 1, got", gen)
+	}
+	if _, ok := started["pid"]; !ok {
+		t.Error("Record doesn't contain pid")
+	}
+
+	if rh.find("upgrade failed") == nil {
+		t.Error("Failed upgrade isn't logged")
+	}
+}
+
+func TestLoggerCloseInherited(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	ln, err := u.Fds.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	proc, errs := u.upgradeProc(t)
+
+	rh := newRecordingHandler()
+	child, err := newUpgrader(&proc.env, Options{Logger: slog.New(rh)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	name := fileName{listenKind, "tcp", ln.Addr().String()}.String()
+	if record := rh.find("inherited fd"); record == nil || record["name"].String() != name {
+		t.Error("Inherited fd isn't logged:", record)
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	record := rh.find("closing unused inherited fd")
+	if record == nil {
+		t.Fatal("Closing unused fd isn't logged")
+	}
+	if record["name"].String() != name {
+		t.Error("Expected name", name, "got", record["name"])
+	}
+	if gen := record["generation"].Int64(); gen != 2 {
+		t.Error("Expected generation 2, got", gen)
+	}
+}
@@ -0,0 +1,192 @@
+package tableflip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reasons passed to Metrics.UpgradeFailed.
+const (
+	upgradeFailedStart     = "start"
+	upgradeFailedState     = "state"
+	upgradeFailedExited    = "exited"
+	upgradeFailedTimeout   = "timeout"
+	upgradeFailedChild     = "failed"
+	upgradeFailedProbe     = "probe"
+	upgradeFailedProbation = "probation"
+	upgradeFailedStopped   = "stopped"
+)
+
+// Metrics receives measurements from an Upgrader. Methods may be called
+// concurrently.
+type Metrics interface {
+	// UpgradeStarted is called when an upgrade is attempted.
+	UpgradeStarted()
+	// UpgradeReady is called when the new process signals readiness,
+	// with the time since the upgrade started.
+	UpgradeReady(timeToReady time.Duration)
+	// UpgradeFailed is called when an upgrade fails. reason is one of
+	// "start", "state", "exited", "timeout", "failed", "probe",
+	// "probation" or "stopped".
+	UpgradeFailed(reason string)
+	// ParentExited is called once the parent has exited, with the time
+	// since Ready was called.
+	ParentExited(drainTime time.Duration)
+	// Fds is called on the first call to Ready. inherited and created
+	// are the number of fds used by the process, which were either
+	// inherited from the parent or newly created. unused is the number
+	// of inherited fds which are closed because they weren't used.
+	Fds(inherited, created, unused int)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) UpgradeStarted()                    {}
+func (nopMetrics) UpgradeReady(time.Duration)         {}
+func (nopMetrics) UpgradeFailed(string)               {}
+func (nopMetrics) ParentExited(time.Duration)         {}
+func (nopMetrics) Fds(inherited, created, unused int) {}
+
+// PrometheusMetrics implements Metrics, and exposes the measurements in
+// the Prometheus text exposition format.
+type PrometheusMetrics struct {
+	mu                         sync.Mutex
+	upgrades                   uint64
+	failures                   map[string]uint64
+	timeToReady, drainTime     *histogram
+	inherited, created, unused int
+}
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+// NewPrometheusMetrics creates metrics without any measurements.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		failures:    make(map[string]uint64),
+		timeToReady: newHistogram(0.1, 0.5, 1, 2.5, 5, 10, 30, 60),
+		drainTime:   newHistogram(1, 5, 10, 30, 60, 300, 900, 3600),
+	}
+}
+
+// UpgradeStarted implements Metrics.
+func (pm *PrometheusMetrics) UpgradeStarted() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.upgrades++
+}
+
+// UpgradeReady implements Metrics.
+func (pm *PrometheusMetrics) UpgradeReady(timeToReady time.Duration) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.timeToReady.observe(timeToReady.Seconds())
+}
+
+// UpgradeFailed implements Metrics.
+func (pm *PrometheusMetrics) UpgradeFailed(reason string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.failures[reason]++
+}
+
+// ParentExited implements Metrics.
+func (pm *PrometheusMetrics) ParentExited(drainTime time.Duration) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.drainTime.observe(drainTime.Seconds())
+}
+
+// Fds implements Metrics.
+func (pm *PrometheusMetrics) Fds(inherited, created, unused int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.inherited, pm.created, pm.unused = inherited, created, unused
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (pm *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	writeHeader(&buf, "tableflip_upgrades_total", "counter", "Number of attempted upgrades.")
+	fmt.Fprintf(&buf, "tableflip_upgrades_total %d\n", pm.upgrades)
+
+	writeHeader(&buf, "tableflip_upgrade_failures_total", "counter", "Number of failed upgrades by reason.")
+	var reasons []string
+	for reason := range pm.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&buf, "tableflip_upgrade_failures_total{reason=%q} %d\n", reason, pm.failures[reason])
+	}
+
+	writeHeader(&buf, "tableflip_upgrade_ready_seconds", "histogram", "Time until the new process signals readiness.")
+	pm.timeToReady.writeTo(&buf, "tableflip_upgrade_ready_seconds")
+
+	writeHeader(&buf, "tableflip_parent_drain_seconds", "histogram", "Time between Ready and the parent exiting.")
+	pm.drainTime.writeTo(&buf, "tableflip_parent_drain_seconds")
+
+	writeHeader(&buf, "tableflip_fds", "gauge", "Number of fds by origin.")
+	fmt.Fprintf(&buf, "tableflip_fds{state=\"inherited\"} %d\n", pm.inherited)
+	fmt.Fprintf(&buf, "tableflip_fds{state=\"created\"} %d\n", pm.created)
+	fmt.Fprintf(&buf, "tableflip_fds{state=\"unused\"} %d\n", pm.unused)
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves all metrics, so that they can be scraped by Prometheus.
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = pm.WriteTo(w)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer, name string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
@@ -0,0 +1,123 @@
+package tableflip
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics()
+	pm.UpgradeStarted()
+	pm.UpgradeStarted()
+	pm.UpgradeReady(2 * time.Second)
+	pm.UpgradeFailed("timeout")
+	pm.ParentExited(20 * time.Second)
+	pm.Fds(2, 1, 3)
+
+	var buf bytes.Buffer
+	if _, err := pm.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"# TYPE tableflip_upgrades_total counter",
+		"tableflip_upgrades_total 2",
+		`tableflip_upgrade_failures_total{reason="timeout"} 1`,
+		"# TYPE tableflip_upgrade_ready_seconds histogram",
+		`tableflip_upgrade_ready_seconds_bucket{le="1"} 0`,
+		`tableflip_upgrade_ready_seconds_bucket{le="2.5"} 1`,
+		`tableflip_upgrade_ready_seconds_bucket{le="+Inf"} 1`,
+		"tableflip_upgrade_ready_seconds_sum 2",
+		"tableflip_upgrade_ready_seconds_count 1",
+		`tableflip_parent_drain_seconds_bucket{le="30"} 1`,
+		`tableflip_fds{state="inherited"} 2`,
+		`tableflip_fds{state="created"} 1`,
+		`tableflip_fds{state="unused"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Output doesn't contain %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestUpgraderMetrics(t *testing.T) {
+	t.Parallel()
+
+	pm := NewPrometheusMetrics()
+	u := newTestUpgrader(Options{Metrics: pm})
+	defer u.Stop()
+
+	ln, err := u.Fds.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	proc, errs := u.upgradeProc(t)
+	proc.exit(errors.New("some error"))
+	if err := <-errs; err == nil {
+		t.Fatal("Upgrade doesn't return an error when the child exits")
+	}
+
+	proc, errs = u.upgradeProc(t)
+
+	childMetrics := NewPrometheusMetrics()
+	child, err := newUpgrader(&proc.env, Options{Metrics: childMetrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	childLn, err := child.Fds.Listen("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer childLn.Close()
+
+	newLn, err := child.Fds.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newLn.Close()
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := pm.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"tableflip_upgrades_total 2",
+		`tableflip_upgrade_failures_total{reason="exited"} 1`,
+		"tableflip_upgrade_ready_seconds_count 1",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Parent output doesn't contain %q:\n%s", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if _, err := childMetrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`tableflip_fds{state="inherited"} 1`,
+		`tableflip_fds{state="created"} 1`,
+		`tableflip_fds{state="unused"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Child output doesn't contain %q:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package tableflip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	migrateKind = "migrate"
+
+	// migrateStateKey is the metadata key of the state of a
+	// migrated connection.
+	migrateStateKey = "state"
+)
+
+// MigratedConn is a connection handed over to the new process.
+type MigratedConn struct {
+	Conn Conn
+	// State is passed to the new process along with Conn, for example
+	// to resume a protocol.
+	State []byte
+}
+
+// ConnProvider returns the connections which are handed over to the new
+// process during an upgrade.
+type ConnProvider func() ([]MigratedConn, error)
+
+type migration struct {
+	mu       sync.Mutex
+	provider ConnProvider
+}
+
+// MigrateConns registers a provider of connections which are handed over
+// to the new process during an upgrade. The provider is called during
+// every upgrade, and the new process receives the connections via
+// MigratedConns.
+//
+// The current process keeps its copies of the connections, and should
+// stop using them once the upgrade has succeeded. Closing them doesn't
+// affect the new process. If the upgrade fails, the connections can be
+// used as before.
+//
+// The provider is called from a different goroutine and must be safe for
+// concurrent use. An error from the provider aborts the upgrade.
+func (u *Upgrader) MigrateConns(provider ConnProvider) {
+	u.migration.mu.Lock()
+	defer u.migration.mu.Unlock()
+
+	u.migration.provider = provider
+}
+
+// collect dups all connections returned by the provider, and adds them
+// to files. The returned dups must be closed once the upgrade is over.
+func (m *migration) collect(files map[fileName]*file) ([]*file, error) {
+	m.mu.Lock()
+	provider := m.provider
+	m.mu.Unlock()
+
+	if provider == nil {
+		return nil, nil
+	}
+
+	conns, err := provider()
+	if err != nil {
+		return nil, fmt.Errorf("can't get connections: %s", err)
+	}
+
+	dups := make([]*file, 0, len(conns))
+	for i, mc := range conns {
+		key := fileName{migrateKind, mc.Conn.RemoteAddr().Network(), strconv.Itoa(i)}
+		dup, err := dupConn(mc.Conn, key)
+		if err != nil {
+			closeFiles(dups)
+			return nil, fmt.Errorf("can't dup connection to %s: %s", mc.Conn.RemoteAddr(), err)
+		}
+
+		dup.meta = map[string]string{migrateStateKey: string(mc.State)}
+		files[key] = dup
+		dups = append(dups, dup)
+	}
+	return dups, nil
+}
+
+func closeFiles(files []*file) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// MigratedConns returns an iterator over the connections handed over by
+// the parent, in the order returned by its ConnProvider. The iterator is
+// empty if there is no parent.
+//
+// Connections must be received before calling Ready, since all inherited
+// fds which haven't been used are closed by Ready. Migrated connections
+// aren't passed on to the next process, unless they are provided again.
+func (u *Upgrader) MigratedConns() *ConnIterator {
+	return &ConnIterator{fds: u.Fds, keys: u.Fds.migratedKeys()}
+}
+
+// ConnIterator iterates over migrated connections.
+//
+//	conns := upg.MigratedConns()
+//	for conns.Next() {
+//		conn, state := conns.Conn(), conns.State()
+//		...
+//	}
+//	if err := conns.Err(); err != nil {
+//		...
+//	}
+type ConnIterator struct {
+	fds   *Fds
+	keys  []fileName
+	conn  net.Conn
+	state []byte
+	err   error
+}
+
+// Next advances to the next connection. It returns false once all
+// connections have been received, or an error occurred.
+func (it *ConnIterator) Next() bool {
+	if it.err != nil || len(it.keys) == 0 {
+		it.conn, it.state = nil, nil
+		return false
+	}
+
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	it.conn, it.state, it.err = it.fds.migratedConn(key)
+	return it.err == nil
+}
+
+// Conn returns the current connection. The caller is responsible for
+// closing it.
+func (it *ConnIterator) Conn() net.Conn {
+	return it.conn
+}
+
+// State returns the state passed along with the current connection.
+func (it *ConnIterator) State() []byte {
+	return it.state
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *ConnIterator) Err() error {
+	return it.err
+}
+
+// migratedKeys returns the names of all inherited migrated connections,
+// in the order they were provided.
+func (f *Fds) migratedKeys() []fileName {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []fileName
+	for key := range f.inherited {
+		if key[0] == migrateKind {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(keys[i][2])
+		b, _ := strconv.Atoi(keys[j][2])
+		return a < b
+	})
+	return keys
+}
+
+// migratedConn returns the inherited migrated connection called key.
+// Unlike other fds, it isn't passed on to the next process.
+func (f *Fds) migratedConn(key fileName) (net.Conn, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file := f.inherited[key]
+	if file == nil {
+		return nil, nil, errors.New("tableflip: migrated connections must be received before calling Ready")
+	}
+	delete(f.inherited, key)
+	defer file.Close()
+
+	conn, err := net.FileConn(file.File)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tableflip: can't inherit migrated connection: %s", err)
+	}
+
+	var state []byte
+	if s, ok := file.meta[migrateStateKey]; ok {
+		state = []byte(s)
+	}
+	return conn, state, nil
+}
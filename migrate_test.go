@@ -0,0 +1,124 @@
+package tableflip
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestUpgraderMigrateConns(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var clients, conns []net.Conn
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		clients = append(clients, client)
+		conns = append(conns, conn)
+	}
+
+	u.MigrateConns(func() ([]MigratedConn, error) {
+		var migrated []MigratedConn
+		for i, conn := range conns {
+			migrated = append(migrated, MigratedConn{conn.(Conn), []byte{byte(i)}})
+		}
+		return migrated, nil
+	})
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	var received []net.Conn
+	it := child.MigratedConns()
+	for it.Next() {
+		defer it.Conn().Close()
+
+		if state := it.State(); len(state) != 1 || int(state[0]) != len(received) {
+			t.Errorf("Expected state %d, got %v", len(received), state)
+		}
+		received = append(received, it.Conn())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal("Can't receive connections:", err)
+	}
+
+	if len(received) != len(conns) {
+		t.Fatalf("Expected %d connections, got %d", len(conns), len(received))
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	// The connections keep working after the parent closes its copies.
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	for i, client := range clients {
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(received[i], buf); err != nil {
+			t.Fatal("Can't read from migrated connection:", err)
+		}
+		if string(buf) != "hello" {
+			t.Errorf("Expected hello, got %q", buf)
+		}
+	}
+
+	if child.MigratedConns().Next() {
+		t.Error("Migrated connections can be received twice")
+	}
+}
+
+func TestUpgraderMigrateConnsFails(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	u.MigrateConns(func() ([]MigratedConn, error) {
+		return nil, errors.New("boom")
+	})
+
+	err := errNotReady
+	for err == errNotReady {
+		err = u.Upgrade()
+	}
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatal("Expected upgrade to fail with provider error, got", err)
+	}
+}
@@ -1,23 +1,57 @@
 package tableflip
 
 import (
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
 	sentinelEnvVar = "TABLEFLIP_HAS_PARENT_7DIU3"
 	notifyReady    = 42
+	notifyFailed   = 43
+
+	// Flags sent after notifyReady. Older parents ignore them.
+	//
+	// acceptsConnCount tells the parent that it may report the number
+	// of its open connections until it exits.
+	acceptsConnCount = 1 << 0
+	// hasProbeAddr is followed by the network and address advertised
+	// for the readiness probe, each prefixed by its length.
+	hasProbeAddr = 1 << 1
+
+	// Sent by the parent instead of a number of connections once the
+	// upgrade has finished, see handoff.ReportsFinished.
+	upgradeFinished = math.MaxUint32
+
+	// Failure messages longer than this are truncated.
+	maxFailureMessage = 4096
 )
 
 type parent struct {
 	wr     *os.File
 	result <-chan error
 	exited <-chan struct{}
+	// handoff is nil if the parent only speaks version 1 of the protocol.
+	handoff *handoff
+
+	mu sync.Mutex
+	// reason is returned via result instead of nil if the parent was
+	// signalled by us.
+	reason error
+	// conns is the number of open connections reported by the parent,
+	// or -1 if the parent hasn't reported any.
+	conns int
+	// finished is closed once the parent reports that the upgrade
+	// has finished.
+	finished chan struct{}
 }
 
 func newParent(env *env) (*parent, map[fileName]*file, error) {
@@ -28,52 +62,228 @@ func newParent(env *env) (*parent, map[fileName]*file, error) {
 	wr := env.newFile(3, "write")
 	rd := env.newFile(4, "read")
 
+	// The names are sent by all versions of the protocol.
 	var names [][]string
 	dec := gob.NewDecoder(rd)
 	if err := dec.Decode(&names); err != nil {
 		return nil, nil, fmt.Errorf("can't decode names from parent process: %s", err)
 	}
 
-	files := make(map[fileName]*file)
+	var h *handoff
 	for i, parts := range names {
+		if len(parts) > 0 && parts[0] == handoffKind {
+			var err error
+			if h, err = readHandoff(env, 5+i); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+
+	var passed []handoffFile
+	if h != nil {
+		passed = h.Files
+	} else {
+		// Version 1 passes fds in the order of names.
+		for i, parts := range names {
+			// Start at 5 to account for stdin, etc. and write
+			// and read pipes.
+			passed = append(passed, handoffFile{Name: parts, Fd: 5 + i})
+		}
+	}
+
+	files := make(map[fileName]*file)
+	for _, hf := range passed {
 		var key fileName
-		copy(key[:], parts)
+		copy(key[:], hf.Name)
 
-		// Start at 5 to account for stdin, etc. and write
-		// and read pipes.
-		fd := 5 + i
-		env.closeOnExec(fd)
+		env.closeOnExec(hf.Fd)
 		files[key] = &file{
-			env.newFile(uintptr(fd), key.String()),
-			uintptr(fd),
+			env.newFile(uintptr(hf.Fd), key.String()),
+			uintptr(hf.Fd),
+			hf.Meta,
 		}
 	}
 
 	result := make(chan error, 1)
 	exited := make(chan struct{})
+	ps := &parent{
+		wr:       wr,
+		result:   result,
+		exited:   exited,
+		handoff:  h,
+		conns:    -1,
+		finished: make(chan struct{}),
+	}
+
 	go func() {
 		defer rd.Close()
 
-		n, err := io.Copy(ioutil.Discard, rd)
-		if n != 0 {
+		err := ps.readConns(rd)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
 			err = errors.New("unexpected data from parent process")
 		} else if err != nil {
 			err = fmt.Errorf("unexpected error while waiting for parent to exit: %s", err)
+		} else {
+			ps.mu.Lock()
+			err = ps.reason
+			ps.mu.Unlock()
 		}
 		result <- err
 		close(exited)
 	}()
 
-	return &parent{
-		wr:     wr,
-		result: result,
-		exited: exited,
-	}, files, nil
+	return ps, files, nil
+}
+
+// readHandoff decodes the handoff message sent by parents speaking
+// version 2 or later of the protocol from fd.
+func readHandoff(env *env, fd int) (*handoff, error) {
+	env.closeOnExec(fd)
+	rd := env.newFile(uintptr(fd), "handoff")
+	defer rd.Close()
+
+	var h handoff
+	if err := gob.NewDecoder(rd).Decode(&h); err != nil {
+		return nil, fmt.Errorf("can't decode handoff from parent process: %s", err)
+	}
+
+	if h.Version < 2 {
+		return nil, fmt.Errorf("invalid handoff version %d", h.Version)
+	}
+
+	return &h, nil
+}
+
+// generation returns the generation of the current process.
+func (ps *parent) generation() int {
+	if ps.handoff == nil {
+		// Parents speaking version 1 don't track generations, so
+		// assume that the parent was the first one.
+		return 2
+	}
+	return ps.handoff.Generation
 }
 
-func (ps *parent) sendReady() error {
+// startTime returns the time at which the first generation started.
+func (ps *parent) startTime() time.Time {
+	if ps.handoff == nil {
+		return time.Time{}
+	}
+	return ps.handoff.StartTime
+}
+
+// pid returns the PID of the parent.
+func (ps *parent) pid() int {
+	if ps.handoff == nil {
+		// Parents speaking version 1 are still our parent process,
+		// unless they have already exited.
+		return os.Getppid()
+	}
+	return ps.handoff.ParentPID
+}
+
+// readConns reads the number of open connections sent by the parent
+// until it exits.
+func (ps *parent) readConns(rd io.Reader) error {
+	for {
+		var n uint32
+		if err := binary.Read(rd, binary.BigEndian, &n); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if n == upgradeFinished {
+			select {
+			case <-ps.finished:
+			default:
+				close(ps.finished)
+			}
+			continue
+		}
+
+		ps.mu.Lock()
+		ps.conns = int(n)
+		ps.mu.Unlock()
+	}
+}
+
+// upgradeFinished returns a channel which is closed once the parent
+// has finished the upgrade, which includes its probation period.
+// Parents which don't report this are considered finished right away.
+func (ps *parent) upgradeFinished() <-chan struct{} {
+	if ps.handoff == nil || !ps.handoff.ReportsFinished {
+		finished := make(chan struct{})
+		close(finished)
+		return finished
+	}
+	return ps.finished
+}
+
+// openConns returns the number of open connections reported by
+// the parent.
+func (ps *parent) openConns() (int, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.conns, ps.conns >= 0
+}
+
+// signal sends sig to the parent. Once the parent has exited, reason
+// is returned via result.
+//
+// Must only be called while the parent hasn't exited, since the PID
+// of parents speaking version 1 of the protocol is only known until then.
+func (ps *parent) signal(env *env, sig os.Signal, reason error) error {
+	pid := ps.pid()
+	if pid <= 1 {
+		return fmt.Errorf("invalid parent PID %d", pid)
+	}
+
+	ps.mu.Lock()
+	ps.reason = reason
+	ps.mu.Unlock()
+
+	return env.signal(pid, sig)
+}
+
+// sendReady tells the parent that this process is ready. probeAddr
+// is passed to the readiness probe of the parent, and may be nil.
+func (ps *parent) sendReady(probeAddr net.Addr) error {
 	defer ps.wr.Close()
-	if _, err := ps.wr.Write([]byte{notifyReady}); err != nil {
+
+	buf := []byte{notifyReady, acceptsConnCount}
+	if probeAddr != nil {
+		buf[1] |= hasProbeAddr
+		for _, str := range []string{probeAddr.Network(), probeAddr.String()} {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(str)))
+			buf = append(buf, str...)
+		}
+	}
+
+	if _, err := ps.wr.Write(buf); err != nil {
+		return fmt.Errorf("can't notify parent process: %s", err)
+	}
+	return nil
+}
+
+// sendFailure tells the parent that this process can't start. The message
+// is prefixed by its length, since the parent doesn't wait for EOF.
+func (ps *parent) sendFailure(reason error) error {
+	defer ps.wr.Close()
+
+	msg := reason.Error()
+	if len(msg) > maxFailureMessage {
+		msg = msg[:maxFailureMessage]
+	}
+
+	buf := make([]byte, 3+len(msg))
+	buf[0] = notifyFailed
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(msg)))
+	copy(buf[3:], msg)
+
+	if _, err := ps.wr.Write(buf); err != nil {
 		return fmt.Errorf("can't notify parent process: %s", err)
 	}
 	return nil
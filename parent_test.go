@@ -1,12 +1,14 @@
 package tableflip
 
 import (
+	"encoding/gob"
+	"os"
 	"testing"
 )
 
 func TestParentExit(t *testing.T) {
 	env, procs := testEnv()
-	child, err := startChild(env, nil)
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -30,3 +32,147 @@ func TestParentExit(t *testing.T) {
 		t.Fatal("Expect child to detect garbage from parent")
 	}
 }
+
+func TestParentHandoff(t *testing.T) {
+	env, procs := testEnv()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	in := map[fileName]*file{
+		{"r"}: {r, r.Fd(), map[string]string{"key": "value"}},
+		{"w"}: {w, w.Fd(), nil},
+	}
+
+	if _, err := startChild(env, in, UpgradeOptions{}, handoff{Generation: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	proc := <-procs
+	defer proc.exit(nil)
+
+	parent, out, err := newParent(&proc.env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parent.handoff == nil {
+		t.Fatal("Missing handoff")
+	}
+	if parent.handoff.Version != handoffVersion {
+		t.Error("Expected version", handoffVersion, "got", parent.handoff.Version)
+	}
+	if parent.generation() != 7 {
+		t.Error("Expected generation 7, got", parent.generation())
+	}
+	if parent.handoff.ParentPID != os.Getpid() {
+		t.Error("Expected parent PID", os.Getpid(), "got", parent.handoff.ParentPID)
+	}
+	if parent.handoff.Timestamp.IsZero() {
+		t.Error("Missing timestamp")
+	}
+
+	if len(out) != len(in) {
+		t.Fatalf("Expected %d files, got %d", len(in), len(out))
+	}
+	if out[fileName{"r"}].meta["key"] != "value" {
+		t.Error("Metadata isn't passed, got", out[fileName{"r"}].meta)
+	}
+}
+
+func TestParentVersion1(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	namesR, namesW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer namesW.Close()
+
+	// Parents speaking version 1 of the protocol only send names.
+	go gob.NewEncoder(namesW).Encode([][]string{{"r"}})
+
+	proc, err := newTestProcess(
+		[]*os.File{os.Stdin, os.Stdout, os.Stderr, readyW, namesR, r},
+		[]string{sentinelEnvVar + "=yes"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, out, err := newParent(&proc.env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parent.handoff != nil {
+		t.Error("Version 1 parent sent a handoff")
+	}
+	if parent.generation() != 2 {
+		t.Error("Expected generation 2, got", parent.generation())
+	}
+
+	if outFd, ok := out[fileName{"r"}]; !ok {
+		t.Error("Missing file")
+	} else if outFd.Fd() != r.Fd() {
+		t.Error("fd mismatch:", outFd.Fd(), r.Fd())
+	}
+}
+
+func TestChildVersion1(t *testing.T) {
+	env, procs := testEnv()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	in := map[fileName]*file{
+		{"r"}: {r, r.Fd(), nil},
+	}
+
+	if _, err := startChild(env, in, UpgradeOptions{}, handoff{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proc := <-procs
+	defer proc.exit(nil)
+
+	// Children speaking version 1 of the protocol only read names, and
+	// treat the handoff like any other fd.
+	var names [][]string
+	if err := gob.NewDecoder(proc.fds[4]).Decode(&names); err != nil {
+		t.Fatal("Can't decode names:", err)
+	}
+
+	if len(names) != 2 {
+		t.Fatal("Expected two names, got", names)
+	}
+	if names[0][0] != "r" || proc.fds[5] != r {
+		t.Error("Passed file isn't at fd 5")
+	}
+	if names[1][0] != handoffKind {
+		t.Error("Handoff isn't announced in names, got", names[1])
+	}
+	if err := gob.NewDecoder(proc.fds[6]).Decode(&handoff{}); err != nil {
+		t.Error("Can't decode handoff from announced fd:", err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package tableflip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if
+// necessary. The lock is held until all copies of the fd are closed,
+// including those passed to a new process.
+func lockFile(path string) (*file, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := sysConnFd(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := unix.Flock(int(fd), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s is locked by another process", path)
+		}
+		return nil, err
+	}
+
+	return &file{f, fd, nil}, nil
+}
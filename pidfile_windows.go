@@ -0,0 +1,7 @@
+package tableflip
+
+// PID files aren't locked on Windows.
+
+func lockFile(path string) (*file, error) {
+	return nil, nil
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 )
 
@@ -14,6 +16,7 @@ type process interface {
 	fmt.Stringer
 	Signal(sig os.Signal) error
 	Wait() error
+	PID() int
 }
 
 type osProcess struct {
@@ -21,7 +24,42 @@ type osProcess struct {
 	finished bool
 }
 
-func newOSProcess(executable string, args []string, files []*os.File, env []string) (process, error) {
+// resolveCommand turns the executable and working directory of a new
+// process into absolute paths, and makes sure that both exist.
+func resolveCommand(executable, dir string) (string, string, error) {
+	if dir == "" {
+		dir = initialWD
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(initialWD, dir)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid working directory: %s", err)
+	}
+	if !info.IsDir() {
+		return "", "", fmt.Errorf("invalid working directory: %s is not a directory", dir)
+	}
+
+	if strings.Contains(executable, "/") && !filepath.IsAbs(executable) {
+		executable = filepath.Join(initialWD, executable)
+	}
+
+	executable, err = exec.LookPath(executable)
+	if err != nil {
+		return "", "", err
+	}
+
+	if info, err := os.Stat(executable); err != nil {
+		return "", "", err
+	} else if !info.Mode().IsRegular() {
+		return "", "", fmt.Errorf("%s is not a regular file", executable)
+	}
+
+	return executable, dir, nil
+}
+
+func newOSProcess(executable string, args []string, dir string, files []*os.File, env []string) (process, error) {
 	executable, err := exec.LookPath(executable)
 	if err != nil {
 		return nil, err
@@ -37,7 +75,7 @@ func newOSProcess(executable string, args []string, files []*os.File, env []stri
 	}
 
 	attr := &syscall.ProcAttr{
-		Dir:   initialWD,
+		Dir:   dir,
 		Env:   env,
 		Files: fds,
 	}
@@ -59,6 +97,15 @@ func newOSProcess(executable string, args []string, files []*os.File, env []stri
 	return &osProcess{Process: proc}, nil
 }
 
+// signalPID sends sig to the process identified by pid.
+func signalPID(pid int, sig os.Signal) error {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("find pid %d: %s", pid, err)
+	}
+	return proc.Signal(sig)
+}
+
 func (osp *osProcess) Wait() error {
 	if osp.finished {
 		return fmt.Errorf("already waited")
@@ -77,6 +124,10 @@ func (osp *osProcess) Wait() error {
 	return nil
 }
 
+func (osp *osProcess) PID() int {
+	return osp.Pid
+}
+
 func (osp *osProcess) String() string {
 	return fmt.Sprintf("pid=%d", osp.Pid)
 }
@@ -3,9 +3,12 @@ package tableflip
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"golang.org/x/sys/unix"
@@ -33,7 +36,7 @@ func TestFilesAreNonblocking(t *testing.T) {
 		t.Fatal("Read pipe is blocking")
 	}
 
-	proc, err := newOSProcess("cat", nil, []*os.File{rStdin, os.Stdout, os.Stderr, r}, nil)
+	proc, err := newOSProcess("cat", nil, "", []*os.File{rStdin, os.Stdout, os.Stderr, r}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +60,7 @@ func TestFilesAreNonblocking(t *testing.T) {
 }
 
 func TestArgumentsArePassedCorrectly(t *testing.T) {
-	proc, err := newOSProcess("printf", []string{""}, []*os.File{os.Stdin, os.Stdout, os.Stderr}, nil)
+	proc, err := newOSProcess("printf", []string{""}, "", []*os.File{os.Stdin, os.Stdout, os.Stderr}, nil)
 	if err != nil {
 		t.Fatal("Can't execute printf:", err)
 	}
@@ -69,6 +72,52 @@ func TestArgumentsArePassedCorrectly(t *testing.T) {
 	}
 }
 
+func TestResolveCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tableflip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	executable, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip("Can't find cat:", err)
+	}
+
+	resolved, resolvedDir, err := resolveCommand("cat", dir)
+	if err != nil {
+		t.Fatal("Can't resolve cat:", err)
+	}
+	if resolved != executable {
+		t.Errorf("Expected %s, got %s", executable, resolved)
+	}
+	if resolvedDir != dir {
+		t.Errorf("Expected working directory %s, got %s", dir, resolvedDir)
+	}
+
+	if _, resolvedDir, err = resolveCommand(executable, ""); err != nil {
+		t.Fatal("Can't resolve absolute path:", err)
+	} else if resolvedDir != initialWD {
+		t.Error("Working directory doesn't default to initial working directory")
+	}
+
+	if _, _, err := resolveCommand(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("Resolving a missing executable should fail")
+	}
+
+	if _, _, err := resolveCommand("cat", filepath.Join(dir, "missing")); err == nil {
+		t.Error("Resolving a missing working directory should fail")
+	}
+
+	if _, _, err := resolveCommand("cat", executable); err == nil {
+		t.Error("Resolving a file as working directory should fail")
+	}
+
+	if _, _, err := resolveCommand(dir, ""); err == nil {
+		t.Error("Resolving a directory as executable should fail")
+	}
+}
+
 func isNonblock(tb testing.TB, file *os.File) (nonblocking bool) {
 	tb.Helper()
 
@@ -97,8 +146,14 @@ type testProcess struct {
 	sigErr  chan error
 	waitErr chan error
 	quit    chan struct{}
+	pid     int
+
+	executable, dir string
+	args            []string
 }
 
+var testPID int32 = 1000
+
 func newTestProcess(fds []*os.File, envstr []string) (*testProcess, error) {
 	environ := make(map[string]string)
 	for _, entry := range envstr {
@@ -110,8 +165,8 @@ func newTestProcess(fds []*os.File, envstr []string) (*testProcess, error) {
 	}
 
 	return &testProcess{
-		fds,
-		env{
+		fds: fds,
+		env: env{
 			newFile: func(fd uintptr, name string) *os.File {
 				return fds[fd]
 			},
@@ -120,10 +175,11 @@ func newTestProcess(fds []*os.File, envstr []string) (*testProcess, error) {
 			},
 			closeOnExec: func(int) {},
 		},
-		make(chan os.Signal, 1),
-		make(chan error),
-		make(chan error),
-		make(chan struct{}),
+		signals: make(chan os.Signal, 1),
+		sigErr:  make(chan error),
+		waitErr: make(chan error),
+		quit:    make(chan struct{}),
+		pid:     int(atomic.AddInt32(&testPID, 1)),
 	}, nil
 }
 
@@ -145,6 +201,10 @@ func (tp *testProcess) Wait() error {
 	}
 }
 
+func (tp *testProcess) PID() int {
+	return tp.pid
+}
+
 func (tp *testProcess) String() string {
 	return fmt.Sprintf("tp=%p", tp)
 }
@@ -168,5 +228,13 @@ func (tp *testProcess) notify() (map[fileName]*file, <-chan error, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	return files, parent.result, parent.sendReady()
+	return files, parent.result, parent.sendReady(nil)
+}
+
+func (tp *testProcess) fail(reason error) error {
+	parent, _, err := newParent(&tp.env)
+	if err != nil {
+		return err
+	}
+	return parent.sendFailure(reason)
 }
@@ -0,0 +1,95 @@
+package tableflip
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SignalOptions control the signal handling of the Upgrader.
+//
+// Each signal should only appear in one of the lists.
+type SignalOptions struct {
+	// Signals which call Upgrade. Defaults to SIGHUP.
+	Upgrade []os.Signal
+	// Signals which call Stop. Defaults to SIGINT and SIGTERM.
+	Stop []os.Signal
+	// Signals which call OnReopen, for example to reopen log files.
+	Reopen []os.Signal
+
+	// OnUpgradeError is called with the error returned by an upgrade
+	// triggered by a signal.
+	OnUpgradeError func(err error)
+	// OnReopen is called when one of the Reopen signals is received.
+	OnReopen func()
+}
+
+func (opts *SignalOptions) signals() []os.Signal {
+	if len(opts.Upgrade) == 0 {
+		opts.Upgrade = []os.Signal{syscall.SIGHUP}
+	}
+	if len(opts.Stop) == 0 {
+		opts.Stop = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+
+	var all []os.Signal
+	all = append(all, opts.Upgrade...)
+	all = append(all, opts.Stop...)
+	all = append(all, opts.Reopen...)
+	return all
+}
+
+func containsSignal(signals []os.Signal, sig os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Upgrader) handleSignals(opts SignalOptions, sigs <-chan os.Signal) {
+	for {
+		select {
+		case <-u.stopC:
+			return
+
+		case <-u.exitC:
+			// Signals are stopped after an upgrade.
+			return
+
+		case sig := <-sigs:
+			switch {
+			case containsSignal(opts.Upgrade, sig):
+				// Upgrade blocks until the new process is ready, which
+				// mustn't prevent us from handling other signals.
+				go func() {
+					err := u.Upgrade()
+					if err != nil && opts.OnUpgradeError != nil {
+						opts.OnUpgradeError(err)
+					}
+				}()
+
+			case containsSignal(opts.Stop, sig):
+				u.Stop()
+
+			case containsSignal(opts.Reopen, sig):
+				if opts.OnReopen != nil {
+					opts.OnReopen()
+				}
+			}
+		}
+	}
+}
+
+func (u *Upgrader) stopSignals() {
+	if u.signalC != nil {
+		signal.Stop(u.signalC)
+	}
+}
+
+func (u *Upgrader) notifySignals(opts SignalOptions) {
+	u.signalC = make(chan os.Signal, 1)
+	signal.Notify(u.signalC, opts.signals()...)
+	go u.handleSignals(opts, u.signalC)
+}
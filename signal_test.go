@@ -0,0 +1,156 @@
+package tableflip
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func sendSignal(t *testing.T, sig syscall.Signal) {
+	t.Helper()
+
+	if err := syscall.Kill(os.Getpid(), sig); err != nil {
+		t.Fatal("Can't send signal:", err)
+	}
+}
+
+func TestSignalsUpgrade(t *testing.T) {
+	errs := make(chan error, 1)
+	u := newTestUpgrader(Options{
+		Signals: &SignalOptions{
+			Upgrade: []os.Signal{syscall.SIGUSR1},
+			Stop:    []os.Signal{syscall.SIGUSR2},
+			OnUpgradeError: func(err error) {
+				errs <- err
+			},
+		},
+	})
+	defer u.Stop()
+
+	var proc *testProcess
+	for proc == nil {
+		sendSignal(t, syscall.SIGUSR1)
+
+		select {
+		case err := <-errs:
+			if err != errNotReady {
+				t.Fatal("Upgrade failed:", err)
+			}
+		case proc = <-u.procs:
+		case <-time.After(time.Second):
+			t.Fatal("Signal didn't trigger an upgrade")
+		}
+	}
+
+	proc.exit(errors.New("some error"))
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Expected an error when the new process exits")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Upgrade error wasn't reported")
+	}
+}
+
+func TestSignalsStop(t *testing.T) {
+	u := newTestUpgrader(Options{
+		Signals: &SignalOptions{
+			Upgrade: []os.Signal{syscall.SIGUSR1},
+			Stop:    []os.Signal{syscall.SIGUSR2},
+		},
+	})
+	defer u.Stop()
+
+	sendSignal(t, syscall.SIGUSR2)
+
+	select {
+	case <-u.Exit():
+	case <-time.After(time.Second):
+		t.Fatal("Signal didn't stop the Upgrader")
+	}
+
+	if err := u.Upgrade(); err == nil {
+		t.Error("Upgrade doesn't return an error after stop signal")
+	}
+}
+
+func TestSignalsReopen(t *testing.T) {
+	reopened := make(chan struct{}, 1)
+	u := newTestUpgrader(Options{
+		Signals: &SignalOptions{
+			Upgrade: []os.Signal{syscall.SIGUSR1},
+			Stop:    []os.Signal{syscall.SIGUSR2},
+			Reopen:  []os.Signal{syscall.SIGWINCH},
+			OnReopen: func() {
+				reopened <- struct{}{}
+			},
+		},
+	})
+	defer u.Stop()
+
+	sendSignal(t, syscall.SIGWINCH)
+
+	select {
+	case <-reopened:
+	case <-time.After(time.Second):
+		t.Fatal("Signal didn't call OnReopen")
+	}
+}
+
+func TestSignalOptionsDefaults(t *testing.T) {
+	var opts SignalOptions
+	all := opts.signals()
+
+	for _, sig := range []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM} {
+		if !containsSignal(all, sig) {
+			t.Error("Missing default signal", sig)
+		}
+	}
+
+	if !containsSignal(opts.Upgrade, syscall.SIGHUP) {
+		t.Error("SIGHUP doesn't trigger an upgrade by default")
+	}
+}
+
+func TestSignalsStoppedAfterUpgrade(t *testing.T) {
+	reopened := make(chan struct{}, 1)
+	u := newTestUpgrader(Options{
+		Signals: &SignalOptions{
+			Upgrade: []os.Signal{syscall.SIGUSR1},
+			Reopen:  []os.Signal{syscall.SIGUSR2},
+			OnReopen: func() {
+				reopened <- struct{}{}
+			},
+		},
+	})
+	defer u.Stop()
+
+	// Make sure that SIGUSR2 doesn't terminate the test once the
+	// Upgrader stops handling it.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	proc, errs := u.upgradeProc(t)
+	if _, _, err := proc.notify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+	<-u.Exit()
+
+	sendSignal(t, syscall.SIGUSR2)
+	<-sigs
+
+	select {
+	case <-reopened:
+		t.Error("Signals are still handled after an upgrade")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
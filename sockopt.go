@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package tableflip
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// socketOptions returns the type and some options of the socket fd.
+// socketType is zero if fd isn't a socket.
+func socketOptions(fd uintptr) (socketType int, reuseAddr, reusePort bool) {
+	socketType, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return 0, false, false
+	}
+
+	v, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR)
+	reuseAddr = err == nil && v != 0
+
+	v, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT)
+	reusePort = err == nil && v != 0
+
+	return socketType, reuseAddr, reusePort
+}
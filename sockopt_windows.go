@@ -0,0 +1,5 @@
+package tableflip
+
+func socketOptions(fd uintptr) (socketType int, reuseAddr, reusePort bool) {
+	return 0, false, false
+}
@@ -0,0 +1,115 @@
+package tableflip
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxStateSize is the maximum combined size of all state passed
+// to the new process.
+const DefaultMaxStateSize = 64 << 20
+
+// StateProvider returns state which is passed to the new process
+// during an upgrade.
+type StateProvider func() ([]byte, error)
+
+type states struct {
+	mu        sync.Mutex
+	providers map[string]StateProvider
+	// Received from the parent, entries are removed once consumed.
+	received map[string][]byte
+	ready    bool
+}
+
+// AddState registers a provider for the state called name. The provider
+// is called during every upgrade, and the result is passed to the new
+// process, which retrieves it via State.
+//
+// Providers are called from a different goroutine and must be safe for
+// concurrent use. An error from a provider aborts the upgrade.
+func (u *Upgrader) AddState(name string, provider StateProvider) {
+	u.states.mu.Lock()
+	defer u.states.mu.Unlock()
+
+	if u.states.providers == nil {
+		u.states.providers = make(map[string]StateProvider)
+	}
+	u.states.providers[name] = provider
+}
+
+// State returns the state called name passed by the parent. It returns nil
+// if the parent didn't pass any state with that name, for example
+// because there is no parent.
+//
+// State must be called before Ready, and each name can only be retrieved
+// once. Ready fails if the parent passed state which wasn't retrieved.
+func (u *Upgrader) State(name string) ([]byte, error) {
+	u.states.mu.Lock()
+	defer u.states.mu.Unlock()
+
+	if u.states.ready {
+		return nil, errors.New("tableflip: state must be retrieved before calling Ready")
+	}
+
+	data := u.states.received[name]
+	delete(u.states.received, name)
+	return data, nil
+}
+
+// collect calls all providers, and checks that their combined
+// size doesn't exceed maxSize.
+func (s *states) collect(maxSize int) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.providers) == 0 {
+		return nil, nil
+	}
+
+	var size int
+	state := make(map[string][]byte, len(s.providers))
+	for name, provider := range s.providers {
+		data, err := provider()
+		if err != nil {
+			return nil, fmt.Errorf("can't get state %q: %s", name, err)
+		}
+
+		size += len(data)
+		if size > maxSize {
+			return nil, fmt.Errorf("state exceeds maximum size of %d bytes", maxSize)
+		}
+		state[name] = data
+	}
+	return state, nil
+}
+
+// finish prevents further calls to State, and returns an error
+// if any state wasn't retrieved.
+func (s *states) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ready = true
+	if len(s.received) == 0 {
+		return nil
+	}
+
+	var names []string
+	for name := range s.received {
+		names = append(names, fmt.Sprintf("%q", name))
+	}
+	sort.Strings(names)
+	s.received = nil
+	return fmt.Errorf("state %s passed by parent wasn't retrieved", strings.Join(names, ", "))
+}
+
+func stateSize(state map[string][]byte) int {
+	var size int
+	for _, data := range state {
+		size += len(data)
+	}
+	return size
+}
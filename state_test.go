@@ -0,0 +1,155 @@
+package tableflip
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStateHandoff(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	u.AddState("cache", func() ([]byte, error) {
+		return []byte("data"), nil
+	})
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	state, err := child.State("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state, []byte("data")) {
+		t.Errorf("Expected state %q, got %q", "data", state)
+	}
+
+	if state, err := child.State("cache"); err != nil || state != nil {
+		t.Error("State can be retrieved twice")
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal("Ready failed:", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	if _, err := child.State("cache"); err == nil {
+		t.Error("State doesn't return an error after Ready")
+	}
+}
+
+func TestStateNotRetrieved(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	u.AddState("cache", func() ([]byte, error) {
+		return []byte("data"), nil
+	})
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	if err := child.Ready(); err == nil {
+		t.Fatal("Ready doesn't return an error if state wasn't retrieved")
+	}
+
+	go proc.recvSignal(nil)
+
+	err = <-errs
+	if err == nil || !strings.Contains(err.Error(), `"cache"`) {
+		t.Fatal("Expected Upgrade to name the state, got", err)
+	}
+}
+
+func TestStateTooLargeForChild(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	u.AddState("cache", func() ([]byte, error) {
+		return make([]byte, 2), nil
+	})
+
+	proc, errs := u.upgradeProc(t)
+
+	if _, err := newUpgrader(&proc.env, Options{MaxStateSize: 1}); err == nil {
+		t.Fatal("newUpgrader accepts state exceeding MaxStateSize")
+	}
+
+	go proc.recvSignal(nil)
+
+	err := <-errs
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum size") {
+		t.Fatal("Expected Upgrade to report why the child failed, got", err)
+	}
+}
+
+func TestStateErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		provider StateProvider
+	}{
+		{"too large", func() ([]byte, error) {
+			return make([]byte, 2), nil
+		}},
+		{"provider fails", func() ([]byte, error) {
+			return nil, errors.New("some error")
+		}},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			u := newTestUpgrader(Options{MaxStateSize: 1})
+			defer u.Stop()
+
+			u.AddState("cache", test.provider)
+
+			err := errNotReady
+			for err == errNotReady {
+				err = u.Upgrade()
+			}
+			if err == nil {
+				t.Fatal("Upgrade doesn't return an error")
+			}
+
+			select {
+			case <-u.procs:
+				t.Error("Upgrade started a new process")
+			default:
+			}
+		})
+	}
+}
+
+func TestStateWithoutParent(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	// newTestUpgrader already called Ready.
+	if _, err := u.State("cache"); err == nil {
+		t.Error("State doesn't return an error after Ready")
+	}
+}
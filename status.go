@@ -0,0 +1,69 @@
+package tableflip
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// States reported in Status.
+const (
+	// The process has called Ready and is serving.
+	StateReady = "ready"
+	// The process is serving, and an upgrade is in progress.
+	StateUpgrading = "upgrading"
+	// The process is serving, and the last upgrade failed.
+	StateUpgradeFailed = "upgrade-failed"
+	// The process was stopped without an upgrade.
+	StateStopped = "stopped"
+)
+
+// Status is written to Options.StatusFile.
+//
+// After triggering an upgrade, wait until either State is StateReady
+// and PID has changed, or State is StateUpgradeFailed.
+// The new process only replaces the file once the upgrade has finished,
+// including Options.ReadinessProbe and Options.ProbationPeriod. The
+// current process doesn't update the file after a successful upgrade.
+type Status struct {
+	PID        int    `json:"pid"`
+	Generation int    `json:"generation"`
+	State      string `json:"state"`
+	// Error is set for StateUpgradeFailed.
+	Error string `json:"error,omitempty"`
+	// Time at which the first generation started.
+	StartTime time.Time `json:"start_time"`
+	// Time at which State was entered.
+	Updated time.Time `json:"updated"`
+}
+
+func (u *Upgrader) writeStatus(state string, err error) error {
+	if u.opts.StatusFile == "" {
+		return nil
+	}
+
+	status := Status{
+		PID:        os.Getpid(),
+		Generation: u.generation,
+		State:      state,
+		StartTime:  u.startTime,
+		Updated:    time.Now(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	data, err := json.Marshal(&status)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(u.opts.StatusFile, append(data, '\n'))
+}
+
+// updateStatus is like writeStatus, but only logs errors.
+func (u *Upgrader) updateStatus(state string, err error) {
+	if err := u.writeStatus(state, err); err != nil {
+		u.logger.Warn("can't write status file", "error", err)
+	}
+}
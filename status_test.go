@@ -0,0 +1,170 @@
+package tableflip
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readStatus(t *testing.T, path string) Status {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// waitStatus waits until the status file at path is in state, written
+// by the given generation.
+func waitStatus(t *testing.T, path, state string, generation int) Status {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		status := readStatus(t, path)
+		if status.State == state && status.Generation == generation {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state %s of generation %d, got %+v", state, generation, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatusFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "status")
+	u := newTestUpgrader(Options{StatusFile: path})
+	defer u.Stop()
+
+	status := readStatus(t, path)
+	if status.State != StateReady || status.PID != os.Getpid() || status.Generation != 1 {
+		t.Error("Unexpected status after Ready:", status)
+	}
+	if status.StartTime.IsZero() || status.Updated.IsZero() {
+		t.Error("Status is missing timestamps:", status)
+	}
+
+	proc, errs := u.upgradeProc(t)
+	if status := readStatus(t, path); status.State != StateUpgrading {
+		t.Error("Expected state", StateUpgrading, "got", status.State)
+	}
+
+	proc.exit(errors.New("some error"))
+	if err := <-errs; err == nil {
+		t.Fatal("Upgrade doesn't return an error when the child exits")
+	}
+
+	status = readStatus(t, path)
+	if status.State != StateUpgradeFailed {
+		t.Error("Expected state", StateUpgradeFailed, "got", status.State)
+	}
+	if !strings.Contains(status.Error, "some error") {
+		t.Error("Status doesn't contain the error:", status.Error)
+	}
+
+	u.Stop()
+	<-u.Exit()
+
+	if status := readStatus(t, path); status.State != StateStopped {
+		t.Error("Expected state", StateStopped, "got", status.State)
+	}
+}
+
+func TestStatusFileUpgrade(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "status")
+	u := newTestUpgrader(Options{StatusFile: path})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{StatusFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	if status := readStatus(t, path); status.State != StateUpgrading {
+		t.Error("New process overwrites status before Ready:", status)
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+	<-u.Exit()
+
+	// The new process writes the file once the parent has reported
+	// that the upgrade finished.
+	waitStatus(t, path, StateReady, 2)
+
+	// Wait for the final update, which races with removing the
+	// temporary directory otherwise.
+	child.Stop()
+	<-child.Exit()
+}
+
+func TestStatusFileProbation(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "status")
+	probation := make(chan struct{}, 1)
+	u := newTestUpgrader(Options{
+		StatusFile:      path,
+		ProbationPeriod: time.Hour,
+		Hooks: Hooks{
+			ProbationStarted: func() { probation <- struct{}{} },
+		},
+	})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{StatusFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	<-probation
+
+	// Give the new process a chance to write the file.
+	time.Sleep(10 * time.Millisecond)
+	if status := readStatus(t, path); status.State != StateUpgrading || status.Generation != 1 {
+		t.Fatal("New process overwrites status during probation:", status)
+	}
+
+	// The new process crashes during probation.
+	child.Stop()
+	<-child.Exit()
+	proc.exit(errors.New("crashed"))
+
+	if err := <-errs; err == nil {
+		t.Fatal("Expected Upgrade to fail")
+	}
+
+	if status := readStatus(t, path); status.State != StateUpgradeFailed || status.Generation != 1 {
+		t.Error("Expected the failed upgrade to be reported, got", status)
+	}
+}
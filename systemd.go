@@ -0,0 +1,310 @@
+//go:build !windows
+// +build !windows
+
+package tableflip
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	notifySocketEnvVar  = "NOTIFY_SOCKET"
+	listenPIDEnvVar     = "LISTEN_PID"
+	listenFdsEnvVar     = "LISTEN_FDS"
+	listenFdNamesEnvVar = "LISTEN_FDNAMES"
+
+	// The first fd passed by systemd, see sd_listen_fds(3).
+	listenFdsStart = 3
+)
+
+// sdNotify sends a state change to the service manager, as described in
+// sd_notify(3). It does nothing if NOTIFY_SOCKET isn't set.
+func sdNotify(env *env, state string) error {
+	return sdNotifyWithFds(env, state)
+}
+
+func sdNotifyWithFds(env *env, state string, fds ...int) error {
+	socket := env.getenv(notifySocketEnvVar)
+	if socket == "" {
+		return nil
+	}
+
+	// net.UnixConn doesn't allow sending control messages on a connected
+	// datagram socket, so use an unbound one instead.
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+
+	return syscall.Sendmsg(fd, []byte(state), oob, &syscall.SockaddrUnix{Name: socket}, 0)
+}
+
+// monotonicUsec returns CLOCK_MONOTONIC in microseconds, as expected
+// by MONOTONIC_USEC.
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
+
+func sdNotifyReady(env *env, pid int) error {
+	return sdNotify(env, fmt.Sprintf("READY=1\nMAINPID=%d", pid))
+}
+
+func sdNotifyReloading(env *env) error {
+	return sdNotify(env, fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+}
+
+// fdNamePrefix marks names of descriptors stored by sdStoreFds.
+const fdNamePrefix = "tableflip-"
+
+// encodeFdName turns name into a valid FDNAME. The result may only
+// contain ASCII characters except ':', and must not exceed 255 characters.
+func encodeFdName(name fileName) (string, error) {
+	fdName := fdNamePrefix + base64.RawURLEncoding.EncodeToString([]byte(strings.Join(name[:], "\x00")))
+	if len(fdName) > 255 {
+		return "", fmt.Errorf("name of %s is too long", name)
+	}
+	return fdName, nil
+}
+
+func decodeFdName(fdName string) (fileName, bool) {
+	if !strings.HasPrefix(fdName, fdNamePrefix) {
+		return fileName{}, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(fdName[len(fdNamePrefix):])
+	if err != nil {
+		return fileName{}, false
+	}
+
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != len(fileName{}) {
+		return fileName{}, false
+	}
+
+	var name fileName
+	copy(name[:], parts)
+	return name, true
+}
+
+// sdStoreFds pushes files into the file descriptor store of the service
+// manager, so that they survive a crash of the process. Stored descriptors
+// are passed back via LISTEN_FDS when the service is restarted.
+func sdStoreFds(env *env, files map[fileName]*file) error {
+	for name, file := range files {
+		fdName, err := encodeFdName(name)
+		if err != nil {
+			return err
+		}
+
+		err = sdNotifyWithFds(env, "FDSTORE=1\nFDNAME="+fdName, int(file.fd))
+		runtime.KeepAlive(file)
+		if err != nil {
+			return fmt.Errorf("can't store %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// sdRemoveFd removes a file stored by sdStoreFds from the file descriptor
+// store of the service manager.
+func sdRemoveFd(env *env, name fileName) error {
+	fdName, err := encodeFdName(name)
+	if err != nil {
+		return err
+	}
+
+	return sdNotify(env, "FDSTOREREMOVE=1\nFDNAME="+fdName)
+}
+
+// listenFds returns the file descriptors passed via socket activation, as
+// described in sd_listen_fds(3).
+//
+// Sockets are keyed by the address they are bound to, so that they are
+// returned by Fds.Listen and friends. Other descriptors are available
+// via Fds.File, using the name from LISTEN_FDNAMES. Descriptors stored by
+// sdStoreFds retain their original name. If an IPv4 and an IPv6 socket are
+// bound to the unspecified address with the same port, the first one is
+// keyed like ":80", and the second one by its full address, like "[::]:80".
+//
+// Sockets passed via socket activation are marked, so that their paths
+// aren't unlinked.
+func listenFds(env *env) (map[fileName]*file, error) {
+	files := make(map[fileName]*file)
+
+	pid, err := strconv.Atoi(env.getenv(listenPIDEnvVar))
+	if err != nil || pid != os.Getpid() {
+		return files, nil
+	}
+
+	n, err := strconv.Atoi(env.getenv(listenFdsEnvVar))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", listenFdsEnvVar, err)
+	}
+
+	var names []string
+	if fdNames := env.getenv(listenFdNamesEnvVar); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		env.closeOnExec(fd)
+
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := env.newFile(uintptr(fd), name)
+		var meta map[string]string
+		key, ok := decodeFdName(name)
+		if !ok {
+			var fullKey fileName
+			key, fullKey, err = activatedFileName(f, name)
+			if err != nil {
+				return nil, fmt.Errorf("fd %d: %s", fd, err)
+			}
+			if _, ok := files[key]; ok {
+				key = fullKey
+			}
+			meta = map[string]string{activatedKey: "1"}
+		}
+
+		if _, ok := files[key]; ok {
+			return nil, fmt.Errorf("fd %d: duplicate %s", fd, key)
+		}
+
+		rawFd, err := sysConnFd(f)
+		if err != nil {
+			return nil, fmt.Errorf("fd %d: %s", fd, err)
+		}
+
+		files[key] = &file{f, rawFd, meta}
+	}
+
+	return files, nil
+}
+
+// activatedFileName derives the key of a socket from getsockname. fullKey
+// is the same as key, except that unspecified IP addresses are included.
+func activatedFileName(f *os.File, name string) (key, fullKey fileName, err error) {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return fileName{}, fileName{}, err
+	}
+
+	var (
+		sotype    int
+		sa        syscall.Sockaddr
+		listening = true
+		sockErr   error
+	)
+	err = raw.Control(func(fd uintptr) {
+		sotype, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if sockErr != nil {
+			return
+		}
+
+		sa, sockErr = syscall.Getsockname(int(fd))
+		if sockErr != nil {
+			return
+		}
+
+		if acceptConn, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); err == nil {
+			listening = acceptConn != 0
+		}
+	})
+	if err != nil {
+		return fileName{}, fileName{}, fmt.Errorf("can't access fd: %s", err)
+	}
+	if errors.Is(sockErr, syscall.ENOTSOCK) {
+		return fileName{fdKind, name}, fileName{fdKind, name}, nil
+	}
+	if sockErr != nil {
+		return fileName{}, fileName{}, sockErr
+	}
+
+	var network, addr, fullAddr string
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		network, addr = "tcp", inetAddr(sa.Addr[:], sa.Port, "")
+		fullAddr = (&net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+		if sotype == syscall.SOCK_DGRAM {
+			network = "udp"
+		}
+
+	case *syscall.SockaddrInet6:
+		var zone string
+		if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+			zone = ifi.Name
+		}
+
+		network, addr = "tcp", inetAddr(sa.Addr[:], sa.Port, zone)
+		fullAddr = (&net.TCPAddr{IP: sa.Addr[:], Port: sa.Port, Zone: zone}).String()
+		if sotype == syscall.SOCK_DGRAM {
+			network = "udp"
+		}
+
+	case *syscall.SockaddrUnix:
+		addr, fullAddr = sa.Name, sa.Name
+		switch sotype {
+		case syscall.SOCK_STREAM:
+			network = "unix"
+		case syscall.SOCK_DGRAM:
+			network = "unixgram"
+		case syscall.SOCK_SEQPACKET:
+			network = "unixpacket"
+		}
+
+	default:
+		return fileName{fdKind, name}, fileName{fdKind, name}, nil
+	}
+
+	var kind string
+	switch {
+	case network == "":
+		return fileName{fdKind, name}, fileName{fdKind, name}, nil
+	case sotype == syscall.SOCK_DGRAM:
+		kind = packetKind
+	case listening:
+		kind = listenKind
+	default:
+		kind = connKind
+	}
+	return fileName{kind, network, addr}, fileName{kind, network, fullAddr}, nil
+}
+
+// inetAddr formats an IP address and port like net.TCPAddr.String, except
+// that unspecified addresses are omitted. This matches the addresses
+// typically passed to Listen, like ":80".
+func inetAddr(ip net.IP, port int, zone string) string {
+	if ip.IsUnspecified() {
+		return ":" + strconv.Itoa(port)
+	}
+	return (&net.TCPAddr{IP: ip, Port: port, Zone: zone}).String()
+}
@@ -0,0 +1,548 @@
+package tableflip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeSystemd listens on a unixgram socket, standing in for
+// the notification socket of the service manager.
+type fakeSystemd struct {
+	*net.UnixConn
+	path string
+}
+
+func newFakeSystemd(t *testing.T) *fakeSystemd {
+	t.Helper()
+
+	path, cleanup := tempSocket(t)
+	t.Cleanup(cleanup)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &fakeSystemd{conn, path}
+}
+
+func (sd *fakeSystemd) env() (*env, chan *testProcess) {
+	env, procs := testEnv()
+	env.getenv = func(key string) string {
+		if key == notifySocketEnvVar {
+			return sd.path
+		}
+		return ""
+	}
+	return env, procs
+}
+
+func (sd *fakeSystemd) recv(t *testing.T) map[string]string {
+	t.Helper()
+
+	if err := sd.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := sd.Read(buf)
+	if err != nil {
+		t.Fatal("Didn't receive notification:", err)
+	}
+
+	state := make(map[string]string)
+	for _, line := range strings.Split(string(buf[:n]), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			t.Fatalf("Invalid notification %q", buf[:n])
+		}
+		state[parts[0]] = parts[1]
+	}
+	return state
+}
+
+// recvFds receives a notification carrying file descriptors, and
+// returns the descriptors along with their FDNAME.
+func (sd *fakeSystemd) recvFds(t *testing.T) (string, []*os.File) {
+	t.Helper()
+
+	if err := sd.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	n, oobn, _, _, err := sd.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal("Didn't receive notification:", err)
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []*os.File
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "stored"))
+		}
+	}
+
+	var fdName string
+	for _, line := range strings.Split(string(buf[:n]), "\n") {
+		if line == "FDSTORE=1" {
+			continue
+		}
+		if !strings.HasPrefix(line, "FDNAME=") {
+			t.Fatalf("Unexpected notification %q", buf[:n])
+		}
+		fdName = strings.TrimPrefix(line, "FDNAME=")
+	}
+	return fdName, files
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	env, _ := testEnv()
+	if err := sdNotify(env, "READY=1"); err != nil {
+		t.Error("Notifying without NOTIFY_SOCKET should be a no-op, got", err)
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	sd := newFakeSystemd(t)
+	env, procs := sd.env()
+
+	u, err := newUpgrader(env, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	if err := u.Ready(); err != nil {
+		t.Fatal("Ready failed:", err)
+	}
+
+	state := sd.recv(t)
+	if state["READY"] != "1" {
+		t.Error("Ready doesn't send READY=1")
+	}
+	if state["MAINPID"] != fmt.Sprint(os.Getpid()) {
+		t.Error("Ready doesn't send MAINPID, got", state["MAINPID"])
+	}
+
+	tu := &testUpgrader{u, procs}
+	proc, errs := tu.upgradeProc(t)
+
+	state = sd.recv(t)
+	if state["RELOADING"] != "1" {
+		t.Error("Upgrade doesn't send RELOADING=1")
+	}
+	if usec := state["MONOTONIC_USEC"]; usec == "" || usec == "0" {
+		t.Error("Upgrade doesn't send MONOTONIC_USEC, got", usec)
+	}
+
+	proc.exit(nil)
+	if err := <-errs; err == nil {
+		t.Fatal("Expected Upgrade to fail")
+	}
+
+	if state := sd.recv(t); state["READY"] != "1" {
+		t.Error("Failed upgrade doesn't send READY=1")
+	}
+
+	u.Stop()
+	<-u.Exit()
+
+	if state := sd.recv(t); state["STOPPING"] != "1" {
+		t.Error("Stop doesn't send STOPPING=1")
+	}
+}
+
+func socketActivationEnv(t *testing.T, pid int, names string, files ...*os.File) *env {
+	t.Helper()
+
+	env, _ := testEnv()
+	env.getenv = func(key string) string {
+		switch key {
+		case listenPIDEnvVar:
+			return fmt.Sprint(pid)
+		case listenFdsEnvVar:
+			return fmt.Sprint(len(files))
+		case listenFdNamesEnvVar:
+			return names
+		}
+		return ""
+	}
+	env.newFile = func(fd uintptr, name string) *os.File {
+		return files[int(fd)-listenFdsStart]
+	}
+	return env
+}
+
+func TestSocketActivation(t *testing.T) {
+	socketPath, cleanup := tempSocket(t)
+	defer cleanup()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	wildcard, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcard.Close()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	unix, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	var files []*os.File
+	for _, conn := range []interface{ File() (*os.File, error) }{
+		tcp.(*net.TCPListener),
+		wildcard.(*net.TCPListener),
+		udp.(*net.UDPConn),
+		unix.(*net.UnixListener),
+	} {
+		file, err := conn.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	files = append(files, r)
+
+	env := socketActivationEnv(t, os.Getpid(), "http:http:dns:control:pipe", files...)
+	u, err := newUpgrader(env, Options{})
+	if err != nil {
+		t.Fatal("Can't create Upgrader:", err)
+	}
+	defer u.Stop()
+
+	port := wildcard.Addr().(*net.TCPAddr).Port
+	for _, addr := range [][2]string{
+		{"tcp", tcp.Addr().String()},
+		{"tcp", fmt.Sprintf(":%d", port)},
+		{"unix", socketPath},
+	} {
+		ln, err := u.Fds.Listener(addr[0], addr[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ln == nil {
+			t.Errorf("Missing %s listener %s", addr[0], addr[1])
+			continue
+		}
+		ln.Close()
+	}
+
+	conn, err := u.Fds.PacketConn("udp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Error("Missing udp packet conn")
+	} else {
+		conn.Close()
+	}
+
+	file, err := u.Fds.File("pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil {
+		t.Error("Missing pipe")
+	} else {
+		file.Close()
+	}
+
+	// Activated sockets are passed on like other fds.
+	child := newFds(u.Fds.copy(), nil)
+	ln, err := child.Listener("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln == nil {
+		t.Fatal("Activated listener isn't passed to the next generation")
+	}
+	ln.Close()
+}
+
+func TestSocketActivationKeepsUnixSockets(t *testing.T) {
+	var (
+		paths []string
+		files []*os.File
+	)
+	for i := 0; i < 2; i++ {
+		path, cleanup := tempSocket(t)
+		defer cleanup()
+
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		defer ln.Close()
+
+		file, err := ln.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		files = append(files, file)
+	}
+
+	u, err := newUpgrader(socketActivationEnv(t, os.Getpid(), "", files...), Options{})
+	if err != nil {
+		t.Fatal("Can't create Upgrader:", err)
+	}
+
+	ln, err := u.Fds.Listen("unix", paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Closes the unused socket.
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	u.Stop()
+	<-u.Exit()
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Error("Activated socket was unlinked:", err)
+		}
+	}
+}
+
+func TestSocketActivationDualStack(t *testing.T) {
+	v4, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v4.Close()
+
+	port := v4.Addr().(*net.TCPAddr).Port
+	v6, err := net.Listen("tcp6", fmt.Sprintf("[::]:%d", port))
+	if err != nil {
+		t.Skip("Can't listen on IPv6:", err)
+	}
+	defer v6.Close()
+
+	var files []*os.File
+	for _, ln := range []net.Listener{v4, v6} {
+		file, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	fds, err := listenFds(socketActivationEnv(t, os.Getpid(), "", files...))
+	if err != nil {
+		t.Fatal("Can't inherit sockets bound to the same port:", err)
+	}
+	defer func() {
+		for _, file := range fds {
+			file.Close()
+		}
+	}()
+
+	for _, addr := range []string{fmt.Sprintf(":%d", port), fmt.Sprintf("[::]:%d", port)} {
+		if fds[fileName{listenKind, "tcp", addr}] == nil {
+			t.Error("Missing listener", addr)
+		}
+	}
+}
+
+func TestSocketActivationOtherPID(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	env := socketActivationEnv(t, os.Getpid()+1, "", r)
+	files, err := listenFds(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Error("Fds meant for another process are used")
+	}
+}
+
+func TestEncodeFdName(t *testing.T) {
+	for _, name := range []fileName{
+		{listenKind, "tcp", "[::1]:8080"},
+		{packetKind, "unixgram", "@abstract"},
+		{fdKind, "name"},
+	} {
+		fdName, err := encodeFdName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.ContainsAny(fdName, ":\n") {
+			t.Errorf("Invalid FDNAME %q for %s", fdName, name)
+		}
+
+		decoded, ok := decodeFdName(fdName)
+		if !ok {
+			t.Errorf("Can't decode FDNAME %q", fdName)
+		} else if decoded != name {
+			t.Errorf("Expected %s, got %s", name, decoded)
+		}
+	}
+
+	if _, ok := decodeFdName("http"); ok {
+		t.Error("Decoded FDNAME not created by tableflip")
+	}
+}
+
+func TestFDStore(t *testing.T) {
+	sd := newFakeSystemd(t)
+	env, _ := sd.env()
+
+	u, err := newUpgrader(env, Options{FDStore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	ln, err := u.Fds.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := u.Fds.AddFile("pipe", w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if err := u.Ready(); err != nil {
+		t.Fatal("Ready failed:", err)
+	}
+
+	// Simulate systemd restarting the crashed service, passing
+	// back the stored fds.
+	var (
+		names []string
+		files []*os.File
+	)
+	for i := 0; i < 2; i++ {
+		fdName, stored := sd.recvFds(t)
+		if len(stored) != 1 {
+			t.Fatalf("Expected a single fd, got %d", len(stored))
+		}
+		defer stored[0].Close()
+
+		names = append(names, fdName)
+		files = append(files, stored[0])
+	}
+
+	if state := sd.recv(t); state["READY"] != "1" {
+		t.Error("Ready doesn't send READY=1 after storing fds")
+	}
+
+	restarted, err := newUpgrader(socketActivationEnv(t, os.Getpid(), strings.Join(names, ":"), files...), Options{})
+	if err != nil {
+		t.Fatal("Can't create Upgrader:", err)
+	}
+	defer restarted.Stop()
+
+	inherited, err := restarted.Fds.Listener("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inherited == nil {
+		t.Fatal("Stored listener isn't recovered")
+	}
+	inherited.Close()
+
+	file, err := restarted.Fds.File("pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil {
+		t.Fatal("Stored file isn't recovered")
+	}
+	defer file.Close()
+
+	if _, err := file.Write([]byte("x")); err != nil {
+		t.Fatal("Can't write to recovered pipe:", err)
+	}
+
+	var b [1]byte
+	if _, err := r.Read(b[:]); err != nil || b[0] != 'x' {
+		t.Error("Recovered pipe isn't the stored one")
+	}
+}
+
+func TestFDStoreRemove(t *testing.T) {
+	sd := newFakeSystemd(t)
+	env, _ := sd.env()
+
+	u, err := newUpgrader(env, Options{FDStore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	ln, err := u.Fds.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if err := u.Fds.RemoveListener("tcp", ln.Addr().String()); err != nil {
+		t.Fatal("Can't remove listener:", err)
+	}
+
+	state := sd.recv(t)
+	if state["FDSTOREREMOVE"] != "1" {
+		t.Error("Remove doesn't send FDSTOREREMOVE=1")
+	}
+
+	name, ok := decodeFdName(state["FDNAME"])
+	if !ok || name != (fileName{listenKind, "tcp", ln.Addr().String()}) {
+		t.Errorf("Remove sends FDNAME %q", state["FDNAME"])
+	}
+}
@@ -0,0 +1,27 @@
+package tableflip
+
+// systemd doesn't exist on Windows, notifications are a no-op.
+
+func sdNotify(env *env, state string) error {
+	return nil
+}
+
+func sdStoreFds(env *env, files map[fileName]*file) error {
+	return nil
+}
+
+func sdRemoveFd(env *env, name fileName) error {
+	return nil
+}
+
+func sdNotifyReady(env *env, pid int) error {
+	return nil
+}
+
+func sdNotifyReloading(env *env) error {
+	return nil
+}
+
+func listenFds(env *env) (map[fileName]*file, error) {
+	return make(map[fileName]*file), nil
+}
@@ -1,20 +1,46 @@
 package testing
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
 	"os"
+
+	"github.com/cloudflare/tableflip"
 )
 
 type Fds struct{}
 
 // Listen returns a listener by calling net.Listen directly
 //
-// Note: In the stub implementation, this is the only function that
-// actually does anything
+// Note: In the stub implementation, this and ListenTLS are the only
+// functions that actually do anything
 func (f *Fds) Listen(network, addr string) (net.Listener, error) {
 	return net.Listen(network, addr)
 }
 
+// ListenTLS returns a listener by calling tls.Listen directly
+func (f *Fds) ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
+	return tls.Listen(network, addr, config)
+}
+
+// ListenTracked returns a tracked listener created by calling net.Listen
+// directly. Its connections are counted, but never reported anywhere.
+func (f *Fds) ListenTracked(network, addr string) (*tableflip.TrackedListener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tln, ok := ln.(tableflip.Listener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("%T doesn't implement tableflip.Listener", ln)
+	}
+
+	return &tableflip.TrackedListener{Listener: tln}, nil
+}
+
 // Listener always returns nil, since it is impossible to inherit with
 // the stub implementation
 func (f *Fds) Listener(network, addr string) (net.Listener, error) {
@@ -50,3 +76,39 @@ func (f *Fds) File(name string) (*os.File, error) {
 func (f *Fds) AddFile(name string, file *os.File) error {
 	return nil
 }
+
+// Inherited always returns nil, since it is impossible to inherit with
+// the stub implementation
+func (f *Fds) Inherited() []tableflip.Descriptor {
+	return nil
+}
+
+// Used always returns nil, since there is no reason to track descriptors
+// in the stub implementation
+func (f *Fds) Used() []tableflip.Descriptor {
+	return nil
+}
+
+// Remove does nothing, since there is no reason to track descriptors
+// in the stub implementation
+func (f *Fds) Remove(kind, network, addr string) error {
+	return nil
+}
+
+// RemoveListener does nothing, since there is no reason to track
+// listeners in the stub implementation
+func (f *Fds) RemoveListener(network, addr string) error {
+	return nil
+}
+
+// RemoveConn does nothing, since there is no reason to track connections
+// in the stub implementation
+func (f *Fds) RemoveConn(network, addr string) error {
+	return nil
+}
+
+// RemoveFile does nothing, since there is no reason to track files
+// in the stub implementation
+func (f *Fds) RemoveFile(name string) error {
+	return nil
+}
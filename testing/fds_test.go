@@ -1,6 +1,7 @@
 package testing
 
 import (
+	"net"
 	"testing"
 )
 
@@ -22,3 +23,32 @@ func TestFdsListen(t *testing.T) {
 		ln.Close()
 	}
 }
+
+func TestFdsListenTracked(t *testing.T) {
+	fds := &Fds{}
+
+	ln, err := fds.ListenTracked("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ln.Conns(); n != 1 {
+		t.Error("Expected 1 open connection, got", n)
+	}
+
+	conn.Close()
+	if n := ln.Conns(); n != 0 {
+		t.Error("Expected no open connections, got", n)
+	}
+}
@@ -6,6 +6,8 @@ package testing
 
 import (
 	"context"
+	"net"
+	"time"
 
 	"github.com/cloudflare/tableflip"
 )
@@ -14,6 +16,7 @@ import (
 // actually do anything special.
 type Upgrader struct {
 	*Fds
+	startTime time.Time
 }
 
 // New creates a new stub Upgrader.
@@ -28,6 +31,7 @@ func New() (*Upgrader, error) {
 func newStubUpgrader() *Upgrader {
 	return &Upgrader{
 		&Fds{},
+		time.Now(),
 	}
 }
 
@@ -39,6 +43,12 @@ func (u *Upgrader) Ready() error {
 	return nil
 }
 
+// Fail does nothing, since the stub implementation never has a parent
+// to report to.
+func (u *Upgrader) Fail(err error) error {
+	return nil
+}
+
 // Exit returns a channel which is closed when the process should
 // exit.
 // We can return nil here because reading from a nil channel blocks
@@ -63,8 +73,67 @@ func (u *Upgrader) HasParent() bool {
 	return false
 }
 
+// Generation is always 1, since the stub implementation can never
+// have a parent
+func (u *Upgrader) Generation() int {
+	return 1
+}
+
+// Lineage only contains the start time of the stub Upgrader, since
+// the stub implementation can never have a parent
+func (u *Upgrader) Lineage() tableflip.Lineage {
+	return tableflip.Lineage{
+		Generation: 1,
+		StartTime:  u.startTime,
+	}
+}
+
 // Upgrade always returns an error in the stub implementation,
 // since nothing can be done.
 func (u *Upgrader) Upgrade() error {
 	return tableflip.ErrNotSupported
 }
+
+// UpgradeWithOptions always returns an error in the stub implementation,
+// since nothing can be done.
+func (u *Upgrader) UpgradeWithOptions(opts tableflip.UpgradeOptions) error {
+	return tableflip.ErrNotSupported
+}
+
+// SetUpgradeOptions does nothing, since the stub implementation never
+// starts a new process.
+func (u *Upgrader) SetUpgradeOptions(opts tableflip.UpgradeOptions) {
+}
+
+// AddState does nothing, since the stub implementation never
+// starts a new process.
+func (u *Upgrader) AddState(name string, provider tableflip.StateProvider) {
+}
+
+// State always returns nil, since the stub implementation can never
+// have a parent.
+func (u *Upgrader) State(name string) ([]byte, error) {
+	return nil, nil
+}
+
+// ParentConns always returns false, since the stub implementation can
+// never have a parent.
+func (u *Upgrader) ParentConns() (int, bool) {
+	return 0, false
+}
+
+// MigrateConns does nothing, since the stub implementation never
+// starts a new process.
+func (u *Upgrader) MigrateConns(provider tableflip.ConnProvider) {
+}
+
+// MigratedConns always returns an empty iterator, since the stub
+// implementation can never have a parent.
+func (u *Upgrader) MigratedConns() *tableflip.ConnIterator {
+	return &tableflip.ConnIterator{}
+}
+
+// AdvertiseProbeAddr does nothing, since the stub implementation can
+// never have a parent.
+func (u *Upgrader) AdvertiseProbeAddr(addr net.Addr) {
+}
@@ -0,0 +1,200 @@
+package tableflip
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionTicketKeysKey is the metadata key of the session ticket keys
+	// of a TLS listener.
+	sessionTicketKeysKey = "tls-session-ticket-keys"
+
+	// Session ticket keys are rotated like crypto/tls does it for keys
+	// it generates itself.
+	sessionTicketKeyRotation = 24 * time.Hour
+	sessionTicketKeyLifetime = 7 * sessionTicketKeyRotation
+)
+
+// ListenTLS is like Listen, but wraps the listener using tls.NewListener.
+//
+// The session ticket keys of the listener are passed to new processes,
+// so that clients can resume sessions across upgrades. They are generated
+// when the listener is first created, and rotated in the same way as
+// crypto/tls rotates its automatic keys: a new key is used every 24 hours,
+// and keys are accepted for 7 days. Rotation continues across upgrades.
+//
+// Keys set on config via SetSessionTicketKeys can't be read back, and are
+// replaced. If config.SessionTicketKey is set, it's used instead and isn't
+// rotated or passed on, since new processes are expected to be configured
+// with the same key. Nothing is passed on if config.SessionTicketsDisabled
+// is set. config itself isn't modified.
+//
+// Configs returned by config.GetConfigForClient use the keys of the
+// listener, unless they set their own keys via SetSessionTicketKeys or
+// SessionTicketKey, or disable session tickets. Sessions established by
+// such a config can't be resumed after an upgrade.
+func (f *Fds) ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
+	ln, err := f.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SessionTicketsDisabled || config.SessionTicketKey != [32]byte{} {
+		return tls.NewListener(ln, config), nil
+	}
+
+	if isPortDynamicallyAssigned(addr) {
+		addr = ln.Addr().String()
+	}
+
+	config = config.Clone()
+	r, err := newTicketKeyRotator(f, fileName{listenKind, network, addr}, config, time.Now())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := r.rotate(time.Now()); err != nil {
+			return nil, err
+		}
+		if getConfigForClient == nil {
+			return nil, nil
+		}
+		return getConfigForClient(hello)
+	}
+
+	return tls.NewListener(ln, config), nil
+}
+
+type sessionTicketKey struct {
+	key     [32]byte
+	created time.Time
+}
+
+// ticketKeyRotator rotates the session ticket keys of a TLS listener, and
+// stores them in the metadata of the listener.
+type ticketKeyRotator struct {
+	fds    *Fds
+	name   fileName
+	config *tls.Config
+
+	mu sync.Mutex
+	// keys are ordered from newest to oldest.
+	keys []sessionTicketKey
+}
+
+func newTicketKeyRotator(f *Fds, name fileName, config *tls.Config, now time.Time) (*ticketKeyRotator, error) {
+	f.mu.Lock()
+	file := f.used[name]
+	f.mu.Unlock()
+
+	if file == nil {
+		return nil, fmt.Errorf("tableflip: listener %s %s isn't used", name[1], name[2])
+	}
+
+	var keys []sessionTicketKey
+	if encoded, ok := file.meta[sessionTicketKeysKey]; ok {
+		var err error
+		keys, err = decodeSessionTicketKeys(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("tableflip: invalid session ticket keys for %s %s: %s", name[1], name[2], err)
+		}
+	}
+
+	r := &ticketKeyRotator{fds: f, name: name, config: config, keys: keys}
+	if r.due(now) {
+		if err := r.rotate(now); err != nil {
+			return nil, err
+		}
+	} else {
+		r.update(now)
+	}
+	return r, nil
+}
+
+// due returns whether the newest key is due for rotation.
+func (r *ticketKeyRotator) due(now time.Time) bool {
+	return len(r.keys) == 0 || now.Sub(r.keys[0].created) >= sessionTicketKeyRotation
+}
+
+// rotate adds a new key if the newest one is due for rotation.
+func (r *ticketKeyRotator) rotate(now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.due(now) {
+		return nil
+	}
+
+	key := sessionTicketKey{created: now}
+	if _, err := rand.Read(key.key[:]); err != nil {
+		return fmt.Errorf("tableflip: can't generate session ticket key: %s", err)
+	}
+
+	r.keys = append([]sessionTicketKey{key}, r.keys...)
+	r.update(now)
+	return nil
+}
+
+// update drops expired keys, and applies the remaining ones to the config
+// and the metadata of the listener.
+func (r *ticketKeyRotator) update(now time.Time) {
+	var keys []sessionTicketKey
+	raw := make([][32]byte, 0, len(r.keys))
+	for _, key := range r.keys {
+		if now.Sub(key.created) < sessionTicketKeyLifetime {
+			keys = append(keys, key)
+			raw = append(raw, key.key)
+		}
+	}
+
+	r.keys = keys
+	r.config.SetSessionTicketKeys(raw)
+	r.fds.setMeta(r.name, sessionTicketKeysKey, encodeSessionTicketKeys(keys))
+}
+
+func encodeSessionTicketKeys(keys []sessionTicketKey) string {
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, strconv.FormatInt(key.created.Unix(), 10)+":"+base64.StdEncoding.EncodeToString(key.key[:]))
+	}
+	return strings.Join(encoded, ",")
+}
+
+func decodeSessionTicketKeys(encoded string) ([]sessionTicketKey, error) {
+	var keys []sessionTicketKey
+	for _, part := range strings.Split(encoded, ",") {
+		created, key, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("key %q has no creation time", part)
+		}
+
+		secs, err := strconv.ParseInt(created, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("key has length %d", len(raw))
+		}
+
+		k := sessionTicketKey{created: time.Unix(secs, 0)}
+		copy(k.key[:], raw)
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,207 @@
+package tableflip
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFdsListenTLS(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+
+	parent := newFds(nil, nil)
+	ln, err := parent.ListenTLS("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal("Can't create TLS listener:", err)
+	}
+	addr := ln.Addr().String()
+
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	if testTLSHandshake(t, ln, clientConfig) {
+		t.Fatal("First handshake resumed a session")
+	}
+	ln.Close()
+
+	child := newFds(parent.copy(), nil)
+	ln, err = child.ListenTLS("tcp", addr, config)
+	if err != nil {
+		t.Fatal("Can't inherit TLS listener:", err)
+	}
+	defer ln.Close()
+
+	if !testTLSHandshake(t, ln, clientConfig) {
+		t.Error("Session isn't resumed after an upgrade")
+	}
+}
+
+func TestFdsListenTLSConfigForClient(t *testing.T) {
+	cert := testCertificate(t)
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		},
+	}
+
+	parent := newFds(nil, nil)
+	ln, err := parent.ListenTLS("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal("Can't create TLS listener:", err)
+	}
+	addr := ln.Addr().String()
+
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	testTLSHandshake(t, ln, clientConfig)
+	ln.Close()
+
+	child := newFds(parent.copy(), nil)
+	ln, err = child.ListenTLS("tcp", addr, config)
+	if err != nil {
+		t.Fatal("Can't inherit TLS listener:", err)
+	}
+	defer ln.Close()
+
+	if !testTLSHandshake(t, ln, clientConfig) {
+		t.Error("Config from GetConfigForClient doesn't use the listener's keys")
+	}
+}
+
+// testTLSHandshake connects to ln, and returns whether the session was
+// resumed.
+func testTLSHandshake(tb testing.TB, ln net.Listener, config *tls.Config) bool {
+	tb.Helper()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		// Makes sure that the client receives the session ticket.
+		_, err = conn.Write([]byte{1})
+		errs <- err
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+	if err != nil {
+		tb.Fatal("Can't connect:", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		tb.Fatal("Can't read:", err)
+	}
+
+	if err := <-errs; err != nil {
+		tb.Fatal("Server failed:", err)
+	}
+	return conn.ConnectionState().DidResume
+}
+
+func testCertificate(tb testing.TB) tls.Certificate {
+	tb.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSessionTicketKeyRotation(t *testing.T) {
+	fds := newFds(nil, nil)
+	ln, err := fds.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	name := fileName{listenKind, "tcp", ln.Addr().String()}
+	now := time.Now()
+	r, err := newTicketKeyRotator(fds, name, &tls.Config{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherited := func() []sessionTicketKey {
+		t.Helper()
+
+		keys, err := decodeSessionTicketKeys(fds.copy()[name].meta[sessionTicketKeysKey])
+		if err != nil {
+			t.Fatal("Can't decode keys:", err)
+		}
+		return keys
+	}
+
+	if keys := inherited(); len(keys) != 1 {
+		t.Fatal("Expected one key, got", len(keys))
+	}
+
+	if err := r.rotate(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := inherited(); len(keys) != 1 {
+		t.Fatal("Key was rotated too early")
+	}
+
+	now = now.Add(sessionTicketKeyRotation)
+	if err := r.rotate(now); err != nil {
+		t.Fatal(err)
+	}
+	keys := inherited()
+	if len(keys) != 2 {
+		t.Fatal("Key wasn't rotated, got", len(keys))
+	}
+	if keys[0].created.Unix() != now.Unix() {
+		t.Error("New key isn't used first")
+	}
+
+	// Rotation continues across upgrades.
+	child := newFds(fds.copy(), nil)
+	ln, err = child.Listen("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	now = now.Add(sessionTicketKeyLifetime)
+	if _, err := newTicketKeyRotator(child, name, &tls.Config{}, now); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = decodeSessionTicketKeys(child.copy()[name].meta[sessionTicketKeysKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].created.Unix() != now.Unix() {
+		t.Error("Expired keys weren't dropped:", keys)
+	}
+}
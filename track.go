@@ -0,0 +1,170 @@
+package tableflip
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// connCounter counts live connections.
+type connCounter struct {
+	mu sync.Mutex
+	n  int
+	// changed is closed and replaced whenever n changes.
+	changed chan struct{}
+}
+
+func (c *connCounter) add(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n += delta
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// get returns the current count, and a channel which is closed once
+// the count changes.
+func (c *connCounter) get() (int, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.n, c.changed
+}
+
+// wait blocks until the count is zero.
+func (c *connCounter) wait(ctx context.Context) error {
+	for {
+		n, changed := c.get()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// report writes the count to w whenever it changes, until writing fails.
+func (c *connCounter) report(w io.Writer) {
+	last := -1
+	for {
+		n, changed := c.get()
+		if n != last {
+			if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+				return
+			}
+			last = n
+		}
+		<-changed
+	}
+}
+
+// TrackedListener counts the connections it accepted which are still open.
+//
+// Connections returned by Accept are wrapped, and can't be type asserted
+// to the concrete type of the underlying connection. They implement Conn,
+// so that they can be passed to Fds.AddConn and MigrateConns, as well as
+// CloseRead, CloseWrite and Unwrap, which returns the underlying connection.
+//
+// Use Fds.ListenTracked to create a TrackedListener. A TrackedListener
+// which only has Listener set still counts its own connections, but they
+// aren't reported to the new process.
+type TrackedListener struct {
+	Listener
+	conns connCounter
+	// total counts the connections of all tracked listeners
+	// of an Fds.
+	total *connCounter
+}
+
+// Accept waits for and returns the next connection.
+func (tl *TrackedListener) Accept() (net.Conn, error) {
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tl.conns.add(1)
+	if tl.total != nil {
+		tl.total.add(1)
+	}
+	return &trackedConn{Conn: conn, listener: tl}, nil
+}
+
+// Conns returns the number of accepted connections which are still open.
+func (tl *TrackedListener) Conns() int {
+	n, _ := tl.conns.get()
+	return n
+}
+
+// Drain closes the listener, and waits until all accepted connections
+// have been closed or ctx is cancelled.
+//
+// The listener is still passed to new processes after calling Drain.
+func (tl *TrackedListener) Drain(ctx context.Context) error {
+	if err := tl.Listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return tl.conns.wait(ctx)
+}
+
+type trackedConn struct {
+	net.Conn
+	listener  *TrackedListener
+	closeOnce sync.Once
+}
+
+func (tc *trackedConn) Close() error {
+	err := tc.Conn.Close()
+	tc.closeOnce.Do(func() {
+		tc.listener.conns.add(-1)
+		if tc.listener.total != nil {
+			tc.listener.total.add(-1)
+		}
+	})
+	return err
+}
+
+// Unwrap returns the underlying connection. Closing it directly isn't
+// counted.
+func (tc *trackedConn) Unwrap() net.Conn {
+	return tc.Conn
+}
+
+func (tc *trackedConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := tc.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("tableflip: %T doesn't implement syscall.Conn", tc.Conn)
+	}
+	return sc.SyscallConn()
+}
+
+func (tc *trackedConn) CloseRead() error {
+	cr, ok := tc.Conn.(interface{ CloseRead() error })
+	if !ok {
+		return fmt.Errorf("tableflip: %T doesn't implement CloseRead: %w", tc.Conn, errors.ErrUnsupported)
+	}
+	return cr.CloseRead()
+}
+
+func (tc *trackedConn) CloseWrite() error {
+	cw, ok := tc.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("tableflip: %T doesn't implement CloseWrite: %w", tc.Conn, errors.ErrUnsupported)
+	}
+	return cw.CloseWrite()
+}
@@ -0,0 +1,106 @@
+package tableflip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrackedListener(t *testing.T) {
+	fds := newFds(nil, nil)
+	defer fds.closeUsed()
+
+	ln, err := fds.ListenTracked("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ln.Conns(); n != 1 {
+		t.Fatal("Expected 1 open connection, got", n)
+	}
+	if n, _ := fds.conns.get(); n != 1 {
+		t.Fatal("Expected 1 open connection in Fds, got", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ln.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Drain returned with open connection:", err)
+	}
+
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("Drain doesn't stop accepting")
+	}
+
+	// Closing twice only counts once.
+	conn.Close()
+	conn.Close()
+
+	if err := ln.Drain(context.Background()); err != nil {
+		t.Fatal("Drain returned an error:", err)
+	}
+	if n, _ := fds.conns.get(); n != 0 {
+		t.Fatal("Expected no open connections in Fds, got", n)
+	}
+
+	// The listener is still passed on.
+	if _, used := fds.names(); len(used) != 1 {
+		t.Error("Drain removes the listener from Fds")
+	}
+}
+
+func TestTrackedConnIsConn(t *testing.T) {
+	fds := newFds(nil, nil)
+	defer fds.closeUsed()
+
+	ln, err := fds.ListenTracked("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tc, ok := conn.(Conn)
+	if !ok {
+		t.Fatal("Tracked connection doesn't implement Conn")
+	}
+	if err := fds.AddConn("tcp", "tracked", tc); err != nil {
+		t.Fatal("Can't add tracked connection:", err)
+	}
+
+	if _, ok := conn.(interface{ Unwrap() net.Conn }).Unwrap().(*net.TCPConn); !ok {
+		t.Error("Unwrap doesn't return the underlying connection")
+	}
+
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal("CloseWrite failed:", err)
+	}
+	if n, err := client.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Error("CloseWrite isn't forwarded")
+	}
+}
@@ -2,15 +2,21 @@ package tableflip
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,15 +24,95 @@ import (
 // readiness notification was received.
 const DefaultUpgradeTimeout time.Duration = time.Minute
 
+// DefaultReadinessProbeAttempts is the number of times the readiness probe is
+// run before an upgrade is considered failed.
+const DefaultReadinessProbeAttempts = 3
+
+// DefaultReadinessProbeInterval is the time between attempts of the readiness probe.
+const DefaultReadinessProbeInterval time.Duration = time.Second
+
+// parentKillDelay is the time between asking the parent to exit via
+// SIGTERM and killing it, see Options.ParentDrainTimeout.
+const parentKillDelay = 5 * time.Second
+
 // Options control the behaviour of the Upgrader.
 type Options struct {
 	// Time after which an upgrade is considered failed. Defaults to
 	// DefaultUpgradeTimeout.
 	UpgradeTimeout time.Duration
-	// The PID of a ready process is written to this file.
+	// The PID of a ready process is written to this file. A new process
+	// only writes it once the upgrade has finished, including
+	// ReadinessProbe and ProbationPeriod. Only a single process may use
+	// the file at a time, which is ensured by locking PIDFile + ".lock".
+	// The lock is passed on during an upgrade. The file is removed when
+	// the process is stopped.
 	PIDFile string
 	// ListenConfig is a custom ListenConfig. Defaults to an empty ListenConfig
 	ListenConfig *net.ListenConfig
+	// StatusFile is the path of a JSON file describing the state of the
+	// process, see Status. It's updated whenever an upgrade starts or
+	// finishes, so that external tools can wait for the outcome.
+	StatusFile string
+	// Signals enables built-in signal handling if not nil. Signal handlers
+	// are removed when Stop is called, or once an upgrade has succeeded,
+	// so that the default handling terminates the draining process.
+	Signals *SignalOptions
+	// ReadinessProbe is called after the new process signalled readiness.
+	// The upgrade only succeeds once the probe returns nil, otherwise the
+	// new process is killed. See ProbeTarget for how to reach the new
+	// process.
+	ReadinessProbe func(ctx context.Context, target ProbeTarget) error
+	// Number of times ReadinessProbe is attempted. Defaults to
+	// DefaultReadinessProbeAttempts.
+	ReadinessProbeAttempts int
+	// Time between attempts of ReadinessProbe. Defaults to
+	// DefaultReadinessProbeInterval.
+	ReadinessProbeInterval time.Duration
+	// ProbationPeriod keeps the current process around for the given duration
+	// after the new process has become ready. Upgrade doesn't return and
+	// Exit isn't closed until the period has passed, and the current
+	// process keeps its file descriptors. If the new process exits during
+	// the period, Upgrade returns an error and the current process continues
+	// to serve. Calling Stop ends the period early.
+	//
+	// Since the Upgrader doesn't own the accept loops of the application,
+	// the current process keeps accepting connections during the period,
+	// unless it pauses accepting in Hooks.ProbationStarted.
+	ProbationPeriod time.Duration
+	// ParentDrainTimeout limits the time the parent may take to exit after
+	// the current process has become ready. It starts once the parent has
+	// finished its probation period, see ProbationPeriod. Once it expires,
+	// the parent is sent SIGTERM, and killed if it still hasn't exited
+	// a few seconds later. WaitForParent then returns an error wrapping
+	// ErrParentDrainTimeout. Zero means no limit.
+	ParentDrainTimeout time.Duration
+	// FDStore pushes all used fds into the systemd file descriptor store
+	// when Ready is called. If the process crashes, systemd passes them
+	// back on restart. Requires FileDescriptorStoreMax in the unit file.
+	FDStore bool
+	// Version identifies the build of the current process, and is reported
+	// to the new process via Lineage. Defaults to the version of the main
+	// module, if available.
+	Version string
+	// Hooks are called at specific points in the life cycle of the
+	// Upgrader.
+	Hooks Hooks
+	// ControlSocket is the path of a Unix socket on which the Upgrader
+	// accepts commands, see ControlRequest. The socket is passed to the
+	// new process like other fds. It is only served once Ready has been
+	// called, so that commands don't reach a new process before the
+	// upgrade has finished.
+	ControlSocket string
+	// Logger receives structured records about upgrades and fds. Records
+	// carry the PID and generation of the current process. Nothing is
+	// logged if Logger is nil.
+	Logger *slog.Logger
+	// Metrics receives measurements about upgrades and fds if not nil.
+	// See PrometheusMetrics for an implementation.
+	Metrics Metrics
+	// MaxStateSize limits the combined size of state passed to the new
+	// process, see AddState. Defaults to DefaultMaxStateSize.
+	MaxStateSize int
 }
 
 // Upgrader handles zero downtime upgrades and passing files between processes.
@@ -34,16 +120,26 @@ type Upgrader struct {
 	*Fds
 
 	*env
-	opts      Options
-	parent    *parent
-	parentErr chan error
-	readyOnce sync.Once
-	readyC    chan struct{}
-	stopOnce  sync.Once
-	stopC     chan struct{}
-	upgradeC  chan chan<- error
-	exitC     chan struct{}
-	exitFd    chan neverCloseThisFile
+	opts       Options
+	parent     *parent
+	generation int
+	startTime  time.Time
+	readyTime  time.Time
+	logger     *slog.Logger
+	parentErr  chan error
+	readyOnce  sync.Once
+	readyC     chan struct{}
+	stopOnce   sync.Once
+	stopC      chan struct{}
+	upgradeC   chan upgradeRequest
+	exitC      chan struct{}
+	exitFd     chan neverCloseThisFile
+	signalC    chan os.Signal
+	probeAddr  atomic.Value
+	// upgradeOpts are used by Upgrade, see SetUpgradeOptions.
+	upgradeOpts atomic.Value
+	states      states
+	migration   migration
 }
 
 var (
@@ -53,7 +149,16 @@ var (
 
 var ErrNotSupported = errors.New("tableflip: platform does not support graceful restart")
 
+// ErrParentDrainTimeout is returned by WaitForParent if the parent had to be
+// terminated, see Options.ParentDrainTimeout.
+var ErrParentDrainTimeout = errors.New("tableflip: parent didn't exit in time")
+
 // New creates a new Upgrader. Files are passed from the parent and may be empty.
+// If there is no parent, sockets passed via systemd socket activation are
+// inherited instead.
+//
+// If New fails in a new process, the error is also reported to the parent,
+// whose call to Upgrade returns it.
 //
 // Only the first call to this function will succeed. May return ErrNotSupported.
 func New(opts Options) (upg *Upgrader, err error) {
@@ -85,21 +190,89 @@ func newUpgrader(env *env, opts Options) (*Upgrader, error) {
 		return nil, err
 	}
 
+	if parent == nil {
+		// The first generation may be started via socket activation.
+		files, err = listenFds(env)
+		if err != nil {
+			return nil, fmt.Errorf("tableflip: can't inherit fds from systemd: %s", err)
+		}
+	}
+
 	if opts.UpgradeTimeout <= 0 {
 		opts.UpgradeTimeout = DefaultUpgradeTimeout
 	}
 
+	if opts.ReadinessProbeAttempts <= 0 {
+		opts.ReadinessProbeAttempts = DefaultReadinessProbeAttempts
+	}
+
+	if opts.ReadinessProbeInterval <= 0 {
+		opts.ReadinessProbeInterval = DefaultReadinessProbeInterval
+	}
+
+	if opts.Metrics == nil {
+		opts.Metrics = nopMetrics{}
+	}
+
+	if opts.MaxStateSize <= 0 {
+		opts.MaxStateSize = DefaultMaxStateSize
+	}
+
+	if opts.Version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			opts.Version = info.Main.Version
+		}
+	}
+
+	generation := 1
+	startTime := time.Now()
+	if parent != nil {
+		generation = parent.generation()
+		startTime = parent.startTime()
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = discardLogger
+	}
+	logger = logger.With("pid", os.Getpid(), "generation", generation)
+
+	for key := range files {
+		logger.Debug("inherited fd", "name", key.String())
+	}
+
 	u := &Upgrader{
-		env:       env,
-		opts:      opts,
-		parent:    parent,
-		parentErr: make(chan error, 1),
-		readyC:    make(chan struct{}),
-		stopC:     make(chan struct{}),
-		upgradeC:  make(chan chan<- error),
-		exitC:     make(chan struct{}),
-		exitFd:    make(chan neverCloseThisFile, 1),
-		Fds:       newFds(files, opts.ListenConfig),
+		env:        env,
+		opts:       opts,
+		parent:     parent,
+		generation: generation,
+		startTime:  startTime,
+		logger:     logger,
+		parentErr:  make(chan error, 1),
+		readyC:     make(chan struct{}),
+		stopC:      make(chan struct{}),
+		upgradeC:   make(chan upgradeRequest),
+		exitC:      make(chan struct{}),
+		exitFd:     make(chan neverCloseThisFile, 1),
+		Fds:        newFds(files, opts.ListenConfig),
+	}
+	u.Fds.logger = logger
+	if opts.FDStore {
+		u.Fds.fdStore = env
+	}
+
+	if err := u.init(); err != nil {
+		// The application can't call Fail without an Upgrader, so
+		// tell the parent why the upgrade failed.
+		if parent != nil {
+			_ = parent.sendFailure(err)
+		}
+		u.Fds.closeAll()
+		return nil, err
+	}
+
+	if opts.Signals != nil {
+		u.notifySignals(*opts.Signals)
 	}
 
 	go u.run()
@@ -107,26 +280,106 @@ func newUpgrader(env *env, opts Options) (*Upgrader, error) {
 	return u, nil
 }
 
+// init sets up everything which may fail once fds have been inherited.
+func (u *Upgrader) init() error {
+	if u.opts.PIDFile != "" {
+		if err := u.Fds.lockPIDFile(u.opts.PIDFile); err != nil {
+			return fmt.Errorf("tableflip: can't lock PID file: %s", err)
+		}
+	}
+
+	if u.parent != nil && u.parent.handoff != nil {
+		if size := stateSize(u.parent.handoff.State); size > u.opts.MaxStateSize {
+			return fmt.Errorf("tableflip: state from parent exceeds maximum size of %d bytes", u.opts.MaxStateSize)
+		}
+		u.states.received = u.parent.handoff.State
+	}
+
+	if u.opts.ControlSocket != "" {
+		if err := u.listenControl(u.opts.ControlSocket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Ready signals that the current process is ready to accept connections.
 // It must be called to finish the upgrade.
 //
 // All fds which were inherited but not used are closed after the call to Ready.
+// If there is a parent, the PID and status files are only written and
+// systemd is only notified once the parent has finished the upgrade.
+// If state passed by the parent wasn't retrieved via State, the upgrade
+// is failed instead and an error is returned.
 func (u *Upgrader) Ready() error {
+	if err := u.states.finish(); err != nil {
+		err = fmt.Errorf("tableflip: %s", err)
+		if u.parent != nil {
+			_ = u.parent.sendFailure(err)
+		}
+		return err
+	}
+
 	u.readyOnce.Do(func() {
+		u.opts.Metrics.Fds(u.Fds.counts())
 		u.Fds.closeInherited()
+		u.readyTime = time.Now()
 		close(u.readyC)
 	})
 
+	if u.opts.FDStore {
+		if err := sdStoreFds(u.env, u.Fds.copy()); err != nil {
+			return fmt.Errorf("tableflip: can't store fds: %s", err)
+		}
+	}
+
+	if u.parent == nil {
+		return u.announceReady()
+	}
+
+	probeAddr, _ := u.probeAddr.Load().(net.Addr)
+	return u.parent.sendReady(probeAddr)
+}
+
+// announceReady writes the PID and status files, and tells systemd about
+// the current process. A new process only does so once the parent has
+// finished the upgrade, since the parent may still reject it during the
+// readiness probe or probation period.
+func (u *Upgrader) announceReady() error {
 	if u.opts.PIDFile != "" {
 		if err := writePIDFile(u.opts.PIDFile); err != nil {
 			return fmt.Errorf("tableflip: can't write PID file: %s", err)
 		}
 	}
 
+	if err := u.writeStatus(StateReady, nil); err != nil {
+		return fmt.Errorf("tableflip: can't write status file: %s", err)
+	}
+
+	// Tell systemd about the new main process before the parent exits.
+	if err := sdNotifyReady(u.env, os.Getpid()); err != nil {
+		return fmt.Errorf("tableflip: can't notify systemd: %s", err)
+	}
+	return nil
+}
+
+// announceReadyAsync is like announceReady, but only logs errors.
+func (u *Upgrader) announceReadyAsync() {
+	if err := u.announceReady(); err != nil {
+		u.logger.Error("can't announce readiness", "error", err)
+	}
+}
+
+// Fail signals that the current process can't finish the upgrade. err is
+// reported to the parent, whose call to Upgrade returns an error wrapping it.
+// The process should exit afterwards, otherwise it is killed by the parent.
+//
+// Fail must not be called after Ready. It does nothing if there is no parent.
+func (u *Upgrader) Fail(err error) error {
 	if u.parent == nil {
 		return nil
 	}
-	return u.parent.sendReady()
+	return u.parent.sendFailure(err)
 }
 
 // Exit returns a channel which is closed when the process should
@@ -144,6 +397,8 @@ func (u *Upgrader) Exit() <-chan struct{} {
 // unlinked from the filesystem.
 func (u *Upgrader) Stop() {
 	u.stopOnce.Do(func() {
+		u.stopSignals()
+
 		// Interrupt any running Upgrade(), and
 		// prevent new upgrade from happening.
 		close(u.stopC)
@@ -152,7 +407,10 @@ func (u *Upgrader) Stop() {
 
 // WaitForParent blocks until the parent has exited.
 //
-// Returns an error if the parent misbehaved during shutdown.
+// Returns an error if the parent misbehaved during shutdown, or if it
+// had to be terminated because it exceeded Options.ParentDrainTimeout.
+// If ctx is done first, the error includes the number of connections
+// which are still open in the parent, see ParentConns.
 func (u *Upgrader) WaitForParent(ctx context.Context) error {
 	if u.parent == nil {
 		return nil
@@ -163,6 +421,9 @@ func (u *Upgrader) WaitForParent(ctx context.Context) error {
 	case err = <-u.parent.result:
 	case err = <-u.parentErr:
 	case <-ctx.Done():
+		if n, ok := u.parent.openConns(); ok {
+			return fmt.Errorf("%w: parent has %d open connections", ctx.Err(), n)
+		}
 		return ctx.Err()
 	}
 
@@ -173,20 +434,132 @@ func (u *Upgrader) WaitForParent(ctx context.Context) error {
 	return err
 }
 
+// ParentConns returns the number of connections which are still open in
+// the parent, as reported by its tracked listeners, see Fds.ListenTracked.
+// Returns false if there is no parent, or if it hasn't reported any.
+func (u *Upgrader) ParentConns() (int, bool) {
+	if u.parent == nil {
+		return 0, false
+	}
+	return u.parent.openConns()
+}
+
 // HasParent checks if the current process is an upgrade or the first invocation.
 func (u *Upgrader) HasParent() bool {
 	return u.parent != nil
 }
 
-// Upgrade triggers an upgrade.
+// Generation returns the number of processes in the chain of upgrades
+// leading to the current process, starting at 1 for a process without
+// a parent.
+func (u *Upgrader) Generation() int {
+	return u.generation
+}
+
+// Lineage describes the chain of upgrades leading to the current process.
+type Lineage struct {
+	// Generation of the current process, see Upgrader.Generation.
+	Generation int
+	// Time at which the first generation started. Zero if the parent
+	// doesn't report it.
+	StartTime time.Time
+	// PID of the parent, or zero if there is no parent.
+	ParentPID int
+	// Version of the parent as given in Options.Version. Empty if there
+	// is no parent or the parent doesn't report it.
+	ParentVersion string
+}
+
+// Lineage returns information about the chain of upgrades leading to
+// the current process.
+func (u *Upgrader) Lineage() Lineage {
+	l := Lineage{
+		Generation: u.generation,
+		StartTime:  u.startTime,
+	}
+
+	if u.parent != nil {
+		l.ParentPID = u.parent.pid()
+		if u.parent.handoff != nil {
+			l.ParentVersion = u.parent.handoff.ParentVersion
+		}
+	}
+	return l
+}
+
+// ProbeTarget describes the new process to Options.ReadinessProbe.
+type ProbeTarget struct {
+	// PID of the new process.
+	PID int
+	// Addrs are the addresses of all listeners passed to the new process.
+	// Note that the current process shares these listeners, and might
+	// therefore accept connections made by the probe.
+	Addrs []net.Addr
+	// ProbeAddr is only served by the new process, see
+	// Upgrader.AdvertiseProbeAddr. It's nil if the new process didn't
+	// advertise an address.
+	ProbeAddr net.Addr
+}
+
+// AdvertiseProbeAddr tells the parent's readiness probe where to reach
+// the current process, see ProbeTarget. addr should only be served by the
+// current process, for example by a listener which isn't added to Fds,
+// so that the probe can't be answered by the parent.
+//
+// It must be called before Ready.
+func (u *Upgrader) AdvertiseProbeAddr(addr net.Addr) {
+	u.probeAddr.Store(fileAddr{addr.Network(), addr.String()})
+}
+
+// UpgradeOptions control how the new process is started.
+type UpgradeOptions struct {
+	// Path to the executable of the new process. Names without a
+	// slash are looked up in PATH, relative paths are resolved against
+	// the initial working directory. Defaults to os.Args[0].
+	Executable string
+	// Arguments passed to the new process, excluding argv[0].
+	// Defaults to os.Args[1:] if nil.
+	Args []string
+	// Working directory of the new process. Relative paths are resolved
+	// against the initial working directory, which is also the default.
+	Dir string
+	// Environ transforms the environment of the new process. It is passed
+	// a copy of the current environment, and may add, override or remove
+	// variables without affecting the current process.
+	Environ func(environ []string) []string
+}
+
+type upgradeRequest struct {
+	opts     UpgradeOptions
+	response chan<- error
+}
+
+// Upgrade triggers an upgrade, using the options set by SetUpgradeOptions.
 func (u *Upgrader) Upgrade() error {
+	opts, _ := u.upgradeOpts.Load().(UpgradeOptions)
+	return u.UpgradeWithOptions(opts)
+}
+
+// SetUpgradeOptions sets the options used by Upgrade, which includes
+// upgrades triggered by signals and the control socket. They apply to all
+// following upgrades until they are set again.
+func (u *Upgrader) SetUpgradeOptions(opts UpgradeOptions) {
+	u.upgradeOpts.Store(opts)
+}
+
+// UpgradeWithOptions triggers an upgrade, starting the new process
+// as described by opts.
+//
+// This allows upgrading into an executable at a different path, or
+// changing the arguments between generations.
+func (u *Upgrader) UpgradeWithOptions(opts UpgradeOptions) error {
 	response := make(chan error, 1)
 	select {
 	case <-u.stopC:
 		return errors.New("terminating")
 	case <-u.exitC:
 		return errors.New("already upgraded")
-	case u.upgradeC <- response:
+	case u.upgradeC <- upgradeRequest{opts, response}:
 	}
 
 	return <-response
@@ -200,6 +573,14 @@ func (u *Upgrader) run() {
 	var (
 		parentExited <-chan struct{}
 		processReady = u.readyC
+		// Closed once the parent has finished the upgrade, including
+		// its probation period.
+		upgradeFinished <-chan struct{}
+		drainTimeout    <-chan time.Time
+		killTimeout     <-chan time.Time
+		// announced is true once the PID and status files describe
+		// the current process, see announceReady.
+		announced = u.parent == nil
 	)
 
 	if u.parent != nil {
@@ -209,73 +590,303 @@ func (u *Upgrader) run() {
 	for {
 		select {
 		case <-parentExited:
+			if upgradeFinished != nil {
+				// The parent exited without reporting that the
+				// upgrade has finished.
+				u.announceReadyAsync()
+				announced = true
+			}
+
 			parentExited = nil
+			upgradeFinished = nil
+			drainTimeout = nil
+			killTimeout = nil
+
+			select {
+			case <-u.readyC:
+				// readyTime is set before readyC is closed.
+				u.opts.Metrics.ParentExited(time.Since(u.readyTime))
+			default:
+			}
+
+			// Share the result with WaitForParent, see there.
+			var err error
+			select {
+			case err = <-u.parent.result:
+			case err = <-u.parentErr:
+			}
+			u.parentErr <- err
+			if err != nil {
+				u.logger.Error("parent exited", "error", err)
+			} else {
+				u.logger.Info("parent exited")
+			}
+			u.opts.Hooks.parentExited(err)
 
 		case <-processReady:
 			processReady = nil
 
+			if parentExited != nil {
+				upgradeFinished = u.parent.upgradeFinished()
+			} else if !announced {
+				u.announceReadyAsync()
+				announced = true
+			}
+
+		case <-upgradeFinished:
+			upgradeFinished = nil
+			u.announceReadyAsync()
+			announced = true
+
+			if u.opts.ParentDrainTimeout > 0 {
+				drainTimeout = time.After(u.opts.ParentDrainTimeout)
+			}
+
+		case <-drainTimeout:
+			drainTimeout = nil
+
+			u.logger.Warn("parent didn't exit in time, terminating", "parent_pid", u.parent.pid(), "timeout", u.opts.ParentDrainTimeout)
+			reason := fmt.Errorf("%w: terminated after %s", ErrParentDrainTimeout, u.opts.ParentDrainTimeout)
+			if err := u.parent.signal(u.env, syscall.SIGTERM, reason); err != nil {
+				u.logger.Error("can't terminate parent", "error", err)
+				continue
+			}
+			killTimeout = time.After(parentKillDelay)
+
+		case <-killTimeout:
+			killTimeout = nil
+
+			u.logger.Warn("parent didn't exit after SIGTERM, killing", "parent_pid", u.parent.pid())
+			reason := fmt.Errorf("%w: killed after %s", ErrParentDrainTimeout, u.opts.ParentDrainTimeout+parentKillDelay)
+			if err := u.parent.signal(u.env, os.Kill, reason); err != nil {
+				u.logger.Error("can't kill parent", "error", err)
+			}
+
 		case <-u.stopC:
+			u.logger.Info("stopping")
+			u.opts.Hooks.stopping()
+			// Until then, the files still describe the parent.
+			if announced {
+				u.updateStatus(StateStopped, nil)
+				if u.opts.PIDFile != "" {
+					// Remove the PID file while still holding the lock.
+					if err := removePIDFile(u.opts.PIDFile); err != nil {
+						u.logger.Warn("can't remove PID file", "error", err)
+					}
+				}
+			}
+			_ = sdNotify(u.env, "STOPPING=1")
 			u.Fds.closeAndRemoveUsed()
 			return
 
 		case request := <-u.upgradeC:
 			if processReady != nil {
-				request <- errNotReady
+				request.response <- errNotReady
 				continue
 			}
 
 			if parentExited != nil {
-				request <- errors.New("parent hasn't exited")
+				request.response <- errors.New("parent hasn't exited")
+				continue
+			}
+
+			if err := u.opts.Hooks.beforeUpgrade(); err != nil {
+				u.logger.Info("upgrade aborted by hook", "error", err)
+				request.response <- fmt.Errorf("upgrade aborted: %w", err)
 				continue
 			}
 
-			file, err := u.doUpgrade()
-			request <- err
+			_ = sdNotifyReloading(u.env)
+			u.updateStatus(StateUpgrading, nil)
+
+			file, err := u.doUpgrade(request.opts)
+			if err != nil {
+				u.logger.Error("upgrade failed", "error", err)
+				u.opts.Hooks.upgradeFailed(err)
+				u.updateStatus(StateUpgradeFailed, err)
+				u.restorePIDFile()
+			}
+			request.response <- err
 
 			if err == nil {
+				u.logger.Info("upgrade finished, exiting")
 				// Save file in exitFd, so that it's only closed when the process
 				// exits. This signals to the new process that the old process
 				// has exited.
 				u.exitFd <- neverCloseThisFile{file}
 				u.Fds.closeUsed()
+				// Restore default signal handling, so that SIGTERM
+				// terminates the draining process.
+				u.stopSignals()
 				return
 			}
+
+			// Leave the reloading state, since we keep running.
+			_ = sdNotifyReady(u.env, os.Getpid())
 		}
 	}
 }
 
-func (u *Upgrader) doUpgrade() (*os.File, error) {
-	child, err := startChild(u.env, u.Fds.copy())
+func (u *Upgrader) doUpgrade(opts UpgradeOptions) (*os.File, error) {
+	u.opts.Metrics.UpgradeStarted()
+	start := time.Now()
+
+	fail := func(reason string, err error) (*os.File, error) {
+		u.opts.Metrics.UpgradeFailed(reason)
+		return nil, err
+	}
+
+	state, err := u.states.collect(u.opts.MaxStateSize)
+	if err != nil {
+		return fail(upgradeFailedState, err)
+	}
+
+	files := u.Fds.copy()
+	migrated, err := u.migration.collect(files)
 	if err != nil {
-		return nil, fmt.Errorf("can't start child: %s", err)
+		return fail(upgradeFailedState, err)
 	}
+	// The new process receives migrated connections before it's ready,
+	// so our copies aren't needed after the upgrade.
+	defer closeFiles(migrated)
+
+	child, err := startChild(u.env, files, opts, handoff{
+		Generation:    u.generation + 1,
+		StartTime:     u.startTime,
+		ParentVersion: u.opts.Version,
+		State:         state,
+	})
+	if err != nil {
+		return fail(upgradeFailedStart, fmt.Errorf("can't start child: %s", err))
+	}
+
+	u.logger.Info("started new process", "child_pid", child.proc.PID())
+	u.opts.Hooks.childStarted(child.proc.PID())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		readyFile    *os.File
+		probeResult  chan error
+		probation    <-chan time.Time
+		readyTimeout = time.After(u.opts.UpgradeTimeout)
+	)
+
+	succeeded := func() (*os.File, error) {
+		if child.acceptsConns {
+			// Lets the child start ParentDrainTimeout.
+			_ = binary.Write(readyFile, binary.BigEndian, uint32(upgradeFinished))
 
-	readyTimeout := time.After(u.opts.UpgradeTimeout)
+			if u.Fds.isTracked() {
+				// Report until we exit, which closes readyFile.
+				go u.Fds.conns.report(readyFile)
+			}
+		}
+		return readyFile, nil
+	}
 	for {
 		select {
 		case request := <-u.upgradeC:
-			request <- errors.New("upgrade in progress")
+			request.response <- errors.New("upgrade in progress")
 
 		case err := <-child.result:
+			if probation != nil {
+				if err == nil {
+					return fail(upgradeFailedProbation, fmt.Errorf("child %s exited during probation", child))
+				}
+				return fail(upgradeFailedProbation, fmt.Errorf("child %s exited during probation: %s", child, err))
+			}
+
 			if err == nil {
-				return nil, fmt.Errorf("child %s exited", child)
+				return fail(upgradeFailedExited, fmt.Errorf("child %s exited", child))
 			}
-			return nil, fmt.Errorf("child %s exited: %s", child, err)
+			return fail(upgradeFailedExited, fmt.Errorf("child %s exited: %s", child, err))
 
 		case <-u.stopC:
+			if probation != nil {
+				// The child is healthy, so let it take over.
+				return succeeded()
+			}
+
 			child.Kill()
-			return nil, errors.New("terminating")
+			return fail(upgradeFailedStopped, errors.New("terminating"))
 
 		case <-readyTimeout:
+			u.logger.Error("new process didn't become ready in time", "child_pid", child.proc.PID(), "timeout", u.opts.UpgradeTimeout)
 			child.Kill()
-			return nil, fmt.Errorf("new child %s timed out", child)
+			return fail(upgradeFailedTimeout, fmt.Errorf("new child %s timed out", child))
 
-		case file := <-child.ready:
-			return file, nil
+		case err := <-child.failed:
+			child.Kill()
+			return fail(upgradeFailedChild, fmt.Errorf("child %s failed: %w", child, err))
+
+		case readyFile = <-child.ready:
+			u.opts.Metrics.UpgradeReady(time.Since(start))
+			u.logger.Info("new process is ready", "child_pid", child.proc.PID())
+			u.opts.Hooks.childReady()
+
+			if u.opts.ReadinessProbe != nil {
+				target := ProbeTarget{
+					PID:       child.proc.PID(),
+					Addrs:     listenerAddrs(files),
+					ProbeAddr: child.probeAddr,
+				}
+
+				probeResult = make(chan error, 1)
+				go func() {
+					probeResult <- u.probe(ctx, target)
+				}()
+				continue
+			}
+
+			if u.opts.ProbationPeriod <= 0 {
+				return succeeded()
+			}
+
+			readyTimeout = nil
+			probation = time.After(u.opts.ProbationPeriod)
+			u.opts.Hooks.probationStarted()
+
+		case err := <-probeResult:
+			if err != nil {
+				// The child closes readyFile once it has exited.
+				child.Kill()
+				return fail(upgradeFailedProbe, fmt.Errorf("child %s failed readiness probe: %s", child, err))
+			}
+
+			if u.opts.ProbationPeriod <= 0 {
+				return succeeded()
+			}
+
+			readyTimeout = nil
+			probation = time.After(u.opts.ProbationPeriod)
+			u.opts.Hooks.probationStarted()
+
+		case <-probation:
+			return succeeded()
 		}
 	}
 }
 
+func (u *Upgrader) probe(ctx context.Context, target ProbeTarget) error {
+	var err error
+	for i := 0; i < u.opts.ReadinessProbeAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(u.opts.ReadinessProbeInterval):
+			case <-ctx.Done():
+				return err
+			}
+		}
+
+		if err = u.opts.ReadinessProbe(ctx, target); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
 // This file must never be closed by the Go runtime, since its used by the
 // child to determine when the parent has died. It must only be closed
 // by the OS.
@@ -286,10 +897,44 @@ type neverCloseThisFile struct {
 }
 
 func writePIDFile(path string) error {
+	return writeFileAtomic(path, []byte(strconv.Itoa(os.Getpid())))
+}
+
+// restorePIDFile writes our PID to the PID file after a failed upgrade,
+// since the new process may have written its PID already.
+func (u *Upgrader) restorePIDFile() {
+	if u.opts.PIDFile == "" {
+		return
+	}
+
+	if err := writePIDFile(u.opts.PIDFile); err != nil {
+		u.logger.Error("can't restore PID file", "error", err)
+	}
+}
+
+// removePIDFile removes the PID file at path, unless it has been
+// written by another process.
+func removePIDFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// writeFileAtomic replaces the file at path, so that readers either see
+// the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
 	dir, file := filepath.Split(path)
 
 	// if dir is empty, the user probably specified just the name
-	// of the pid file expecting it to be created in the current work directory
+	// of the file expecting it to be created in the current work directory
 	if dir == "" {
 		dir = initialWD
 	}
@@ -303,10 +948,10 @@ func writePIDFile(path string) error {
 		return err
 	}
 	defer fh.Close()
-	// Remove temporary PID file if something fails
+	// Remove temporary file if something fails
 	defer os.Remove(fh.Name())
 
-	_, err = fh.WriteString(strconv.Itoa(os.Getpid()))
+	_, err = fh.Write(data)
 	if err != nil {
 		return err
 	}
@@ -3,6 +3,7 @@ package tableflip
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -10,7 +11,9 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -282,6 +285,115 @@ func TestUpgraderTimeout(t *testing.T) {
 	}
 }
 
+func TestUpgraderSetUpgradeOptions(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	u.SetUpgradeOptions(UpgradeOptions{
+		Args: []string{"-color", "green"},
+		Environ: func(environ []string) []string {
+			return append(environ, "COLOR=green")
+		},
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			// Signals and the control socket call Upgrade.
+			err := u.Upgrade()
+			if err != errNotReady {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	var new *testProcess
+	select {
+	case err := <-errs:
+		t.Fatal("Upgrade failed:", err)
+	case new = <-u.procs:
+	}
+
+	if fmt.Sprint(new.args) != "[-color green]" {
+		t.Error("Arguments weren't passed, got", new.args)
+	}
+	if color := new.env.getenv("COLOR"); color != "green" {
+		t.Error("Environment wasn't transformed, got COLOR", color)
+	}
+
+	new.exit(nil)
+	<-errs
+}
+
+func TestUpgraderUpgradeWithOptions(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	dir, err := ioutil.TempDir("", "tableflip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			err := u.UpgradeWithOptions(UpgradeOptions{
+				Executable: executable,
+				Args:       []string{"-flag", "value"},
+				Dir:        dir,
+			})
+			if err != errNotReady {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	var new *testProcess
+	select {
+	case err := <-errs:
+		t.Fatal("UpgradeWithOptions failed:", err)
+	case new = <-u.procs:
+	}
+
+	if new.executable != executable {
+		t.Errorf("Expected executable %s, got %s", executable, new.executable)
+	}
+	if fmt.Sprint(new.args) != "[-flag value]" {
+		t.Error("Arguments weren't passed, got", new.args)
+	}
+	if new.dir != dir {
+		t.Errorf("Expected working directory %s, got %s", dir, new.dir)
+	}
+
+	new.exit(nil)
+	<-errs
+
+	err = u.UpgradeWithOptions(UpgradeOptions{
+		Dir: filepath.Join(dir, "missing"),
+	})
+	if err == nil {
+		t.Error("Expected UpgradeWithOptions to reject invalid working directory")
+	}
+
+	missing := filepath.Join(dir, "missing")
+	err = u.UpgradeWithOptions(UpgradeOptions{Executable: missing})
+	if err == nil || !strings.Contains(err.Error(), "process "+missing+":") {
+		t.Error("Expected error to name the missing executable, got", err)
+	}
+}
+
 func TestUpgraderListenConfig(t *testing.T) {
 	t.Parallel()
 
@@ -344,7 +456,7 @@ func TestUpgraderWaitForParent(t *testing.T) {
 	t.Parallel()
 
 	env, procs := testEnv()
-	child, err := startChild(env, nil)
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -381,6 +493,171 @@ func TestUpgraderWaitForParent(t *testing.T) {
 	}
 }
 
+func TestUpgraderParentDrainTimeout(t *testing.T) {
+	t.Parallel()
+
+	env, procs := testEnv()
+	child, err := startChild(env, nil, UpgradeOptions{}, handoff{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc := <-procs
+	signals := make(chan os.Signal, 2)
+	proc.env.signal = func(pid int, sig os.Signal) error {
+		if pid != os.Getpid() {
+			t.Error("Signal sent to wrong PID", pid)
+		}
+		signals <- sig
+		return nil
+	}
+
+	u, err := newUpgrader(&proc.env, Options{ParentDrainTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	readyFile := <-child.ready
+
+	select {
+	case sig := <-signals:
+		t.Fatal("Parent is signalled before it finished the upgrade:", sig)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := binary.Write(readyFile, binary.BigEndian, uint32(upgradeFinished)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ignore SIGTERM, so that the parent is killed.
+	if sig := <-signals; sig != syscall.SIGTERM {
+		t.Fatal("Expected SIGTERM, got", sig)
+	}
+	if sig := <-signals; sig != os.Kill {
+		t.Fatal("Expected SIGKILL, got", sig)
+	}
+
+	if err := readyFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = u.WaitForParent(context.Background())
+	if !errors.Is(err, ErrParentDrainTimeout) {
+		t.Fatal("Expected ErrParentDrainTimeout, got", err)
+	}
+}
+
+func TestUpgraderParentDrainTimeoutAfterProbation(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{ProbationPeriod: 200 * time.Millisecond})
+	defer u.Stop()
+
+	proc, errs := u.upgradeProc(t)
+
+	signals := make(chan os.Signal, 2)
+	proc.env.signal = func(pid int, sig os.Signal) error {
+		signals <- sig
+		return nil
+	}
+
+	child, err := newUpgrader(&proc.env, Options{ParentDrainTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case sig := <-signals:
+		t.Fatal("Parent is signalled during probation:", sig)
+	case err := <-errs:
+		if err != nil {
+			t.Fatal("Upgrade failed:", err)
+		}
+	}
+
+	if sig := <-signals; sig != syscall.SIGTERM {
+		t.Fatal("Expected SIGTERM after probation, got", sig)
+	}
+}
+
+func TestUpgraderParentConns(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	ln, err := u.ListenTracked("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	if _, ok := child.ParentConns(); ok {
+		t.Fatal("Parent reports connections before child is ready")
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	waitConns := func(want int) {
+		t.Helper()
+
+		for i := 0; i < 100; i++ {
+			if n, ok := child.ParentConns(); ok && n == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		n, ok := child.ParentConns()
+		t.Fatalf("Expected %d open connections in parent, got %d (%t)", want, n, ok)
+	}
+
+	waitConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := child.WaitForParent(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Expected WaitForParent to time out, got", err)
+	}
+
+	conn.Close()
+	waitConns(0)
+}
+
 func TestUpgraderReady(t *testing.T) {
 	t.Parallel()
 
@@ -418,6 +695,274 @@ func TestUpgraderReady(t *testing.T) {
 	}
 }
 
+func TestUpgraderChildFails(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	new, errs := u.upgradeProc(t)
+
+	reason := errors.New("invalid configuration")
+	if err := new.fail(reason); err != nil {
+		t.Fatal("Can't send failure:", err)
+	}
+
+	if sig := new.recvSignal(nil); sig != os.Kill {
+		t.Error("Expected os.Kill, got", sig)
+	}
+
+	err := <-errs
+	if err == nil {
+		t.Fatal("Expected Upgrade to fail")
+	}
+	if errors.Unwrap(err).Error() != reason.Error() {
+		t.Error("Upgrade doesn't wrap the failure message:", err)
+	}
+
+	new.exit(errors.New("exit status 1"))
+}
+
+func TestUpgraderFailWithoutParent(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{})
+	defer u.Stop()
+
+	if err := u.Fail(errors.New("some error")); err != nil {
+		t.Error("Fail without parent returned an error:", err)
+	}
+}
+
+func TestUpgraderReadinessProbe(t *testing.T) {
+	t.Parallel()
+
+	var attempts int
+	probed := make(chan ProbeTarget, 1)
+	u := newTestUpgrader(Options{
+		ReadinessProbeInterval: time.Millisecond,
+		ReadinessProbe: func(ctx context.Context, target ProbeTarget) error {
+			attempts++
+			if attempts < DefaultReadinessProbeAttempts {
+				return errors.New("not serving yet")
+			}
+			probed <- target
+			return nil
+		},
+	})
+	defer u.Stop()
+
+	ln, err := u.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	new, errs := u.upgradeProc(t)
+	if _, _, err := new.notify(); err != nil {
+		t.Fatal("Can't notify Upgrader:", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Expected Upgrade to succeed once the probe passes, got", err)
+	}
+
+	target := <-probed
+	if target.PID != new.PID() {
+		t.Errorf("Probe was passed PID %d instead of %d", target.PID, new.PID())
+	}
+	if addrs := target.Addrs; len(addrs) != 1 || addrs[0].Network() != "tcp" || addrs[0].String() != ln.Addr().String() {
+		t.Error("Probe wasn't passed the listener address, got", addrs)
+	}
+	if target.ProbeAddr != nil {
+		t.Error("Probe was passed an address which wasn't advertised:", target.ProbeAddr)
+	}
+}
+
+func TestUpgraderReadinessProbeAddr(t *testing.T) {
+	t.Parallel()
+
+	probed := make(chan ProbeTarget, 1)
+	u := newTestUpgrader(Options{
+		ReadinessProbe: func(ctx context.Context, target ProbeTarget) error {
+			probed <- target
+			return nil
+		},
+	})
+	defer u.Stop()
+
+	new, errs := u.upgradeProc(t)
+
+	parent, _, err := newParent(&new.env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	if err := parent.sendReady(addr); err != nil {
+		t.Fatal("Can't notify Upgrader:", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	target := <-probed
+	if target.ProbeAddr == nil || target.ProbeAddr.Network() != "tcp" || target.ProbeAddr.String() != addr.String() {
+		t.Error("Probe wasn't passed the advertised address, got", target.ProbeAddr)
+	}
+}
+
+func TestUpgraderReadinessProbeFails(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{
+		ReadinessProbeInterval: time.Millisecond,
+		ReadinessProbe: func(ctx context.Context, target ProbeTarget) error {
+			return errors.New("not serving")
+		},
+	})
+	defer u.Stop()
+
+	new, errs := u.upgradeProc(t)
+	if _, _, err := new.notify(); err != nil {
+		t.Fatal("Can't notify Upgrader:", err)
+	}
+
+	if sig := new.recvSignal(nil); sig != os.Kill {
+		t.Error("Expected os.Kill, got", sig)
+	}
+
+	if err := <-errs; err == nil {
+		t.Error("Expected Upgrade to fail when the probe fails")
+	}
+
+	select {
+	case <-u.Exit():
+		t.Error("Exit() is closed after failed probe")
+	default:
+	}
+
+	new.exit(nil)
+}
+
+func TestUpgraderProbation(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{
+		ProbationPeriod: 10 * time.Millisecond,
+	})
+	defer u.Stop()
+
+	new, errs := u.upgradeProc(t)
+	if _, _, err := new.notify(); err != nil {
+		t.Fatal("Can't notify Upgrader:", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Expected Upgrade to succeed after probation, got", err)
+	}
+
+	select {
+	case <-u.Exit():
+	default:
+		t.Error("Expected Exit() to be closed after probation")
+	}
+}
+
+func TestUpgraderProbationChildExits(t *testing.T) {
+	t.Parallel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	probation := make(chan struct{}, 1)
+	u := newTestUpgrader(Options{
+		ProbationPeriod: time.Hour,
+		PIDFile:         pidFile,
+		Hooks: Hooks{
+			ProbationStarted: func() { probation <- struct{}{} },
+		},
+	})
+	defer u.Stop()
+
+	ln, err := u.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	new, errs := u.upgradeProc(t)
+	if _, _, err := new.notify(); err != nil {
+		t.Fatal("Can't notify Upgrader:", err)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal("Upgrade returned during probation:", err)
+	case <-u.Exit():
+		t.Fatal("Exit() is closed during probation")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	select {
+	case <-probation:
+	default:
+		t.Fatal("ProbationStarted isn't called")
+	}
+
+	// Pretend that the new process wrote its PID.
+	if err := ioutil.WriteFile(pidFile, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	new.exit(errors.New("crashed"))
+	if err := <-errs; err == nil {
+		t.Fatal("Expected Upgrade to fail when the child exits during probation")
+	}
+
+	if pid, err := ioutil.ReadFile(pidFile); err != nil {
+		t.Fatal(err)
+	} else if string(pid) != strconv.Itoa(os.Getpid()) {
+		t.Error("PID file isn't restored after failed probation, got", string(pid))
+	}
+
+	select {
+	case <-u.Exit():
+		t.Fatal("Exit() is closed after failed probation")
+	default:
+	}
+
+	// The listener is retained, and can be used to serve again.
+	if len(listenerAddrs(u.Fds.copy())) != 1 {
+		t.Fatal("Fds were closed after failed probation")
+	}
+}
+
+func TestUpgraderStopEndsProbation(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{
+		ProbationPeriod: time.Hour,
+	})
+	defer u.Stop()
+
+	new, errs := u.upgradeProc(t)
+	if _, _, err := new.notify(); err != nil {
+		t.Fatal("Can't notify Upgrader:", err)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal("Upgrade returned during probation:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	u.Stop()
+	if err := <-errs; err != nil {
+		t.Fatal("Expected Stop to end probation, got", err)
+	}
+
+	<-u.Exit()
+}
+
 func TestUpgraderShutdownCancelsUpgrade(t *testing.T) {
 	t.Parallel()
 
@@ -548,3 +1093,126 @@ func BenchmarkUpgrade(b *testing.B) {
 		})
 	}
 }
+
+func TestUpgraderLineage(t *testing.T) {
+	t.Parallel()
+
+	u := newTestUpgrader(Options{Version: "v1.2.3"})
+	defer u.Stop()
+
+	if gen := u.Generation(); gen != 1 {
+		t.Error("Expected generation 1, got", gen)
+	}
+
+	lineage := u.Lineage()
+	if lineage.StartTime.IsZero() {
+		t.Error("First generation has no start time")
+	}
+	if lineage.ParentPID != 0 || lineage.ParentVersion != "" {
+		t.Error("First generation has a parent:", lineage)
+	}
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Stop()
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	childLineage := child.Lineage()
+	if childLineage.Generation != 2 || child.Generation() != 2 {
+		t.Error("Expected generation 2, got", childLineage.Generation)
+	}
+	if !childLineage.StartTime.Equal(lineage.StartTime) {
+		t.Error("Start time isn't passed to the child:", childLineage.StartTime)
+	}
+	if childLineage.ParentPID != os.Getpid() {
+		t.Error("Expected parent PID", os.Getpid(), "got", childLineage.ParentPID)
+	}
+	if childLineage.ParentVersion != "v1.2.3" {
+		t.Error("Expected parent version v1.2.3, got", childLineage.ParentVersion)
+	}
+}
+
+func TestPIDFileLocked(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "pid")
+	u := newTestUpgrader(Options{PIDFile: file})
+	defer u.Stop()
+
+	env, _ := testEnv()
+	if _, err := newUpgrader(env, Options{PIDFile: file}); err == nil {
+		t.Fatal("Second Upgrader can use a locked PID file")
+	}
+
+	proc, errs := u.upgradeProc(t)
+
+	child, err := newUpgrader(&proc.env, Options{PIDFile: file})
+	if err != nil {
+		t.Fatal("Lock isn't passed to the new process:", err)
+	}
+	defer child.Stop()
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+}
+
+func TestStopRemovesPIDFile(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "pid")
+	u := newTestUpgrader(Options{PIDFile: file})
+
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal("PID file doesn't exist:", err)
+	}
+
+	u.Stop()
+	<-u.Exit()
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("Stop doesn't remove the PID file:", err)
+	}
+
+	// The lock is released, so another process may use the PID file now.
+	env, _ := testEnv()
+	next, err := newUpgrader(env, Options{PIDFile: file})
+	if err != nil {
+		t.Fatal("PID file is still locked after Stop:", err)
+	}
+	next.Stop()
+	<-next.Exit()
+}
+
+func TestStopKeepsForeignPIDFile(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "pid")
+	u := newTestUpgrader(Options{PIDFile: file})
+
+	if err := ioutil.WriteFile(file, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u.Stop()
+	<-u.Exit()
+
+	if _, err := os.Stat(file); err != nil {
+		t.Error("Stop removes a PID file written by another process:", err)
+	}
+}